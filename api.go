@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// signingKey responds with the public key for checking manifest signatures.
+func signingKey(w http.ResponseWriter) {
+	key, err := storage.PublicKey()
+	if os.IsNotExist(err) {
+		apiError(w, 404, "manifests are not signed")
+		return
+	}
+	if err != nil {
+		apiError(w, 500, err.Error())
+		return
+	}
+	apiResponse(w, 200, map[string]string{
+		"algorithm": "ed25519",
+		"key":       base64.StdEncoding.EncodeToString(key),
+	})
+}
+
+// buildSummary is an entry in the list of a project's builds.
+type buildSummary struct {
+	storage.BuildRef
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	URL      string    `json:"url"`
+}
+
+// listBuilds responds with the list of the project's builds, newest first.
+func listBuilds(w http.ResponseWriter, projectName string) {
+	refs, err := storage.BuildNumbers(projectName)
+	if err != nil {
+		apiError(w, 500, err.Error())
+		return
+	}
+	list := make([]buildSummary, 0, len(refs))
+	for i := len(refs) - 1; i >= 0; i-- {
+		r := refs[i]
+		b := buildSummary{
+			BuildRef: r,
+			URL:      urlFor("build", projectName, strconv.Itoa(r.Number)),
+		}
+		info, err := storage.Info(projectName, r.Branch, r.Version)
+		if err == nil && info.Number == r.Number {
+			b.Status = info.Status
+			b.Started = info.Started
+			b.Finished = info.Finished
+		}
+		list = append(list, b)
+	}
+	apiResponse(w, 200, list)
+}
+
+// showBuild responds with the description of the build with the given number.
+func showBuild(w http.ResponseWriter, projectName string, number int) {
+	r, err := storage.BuildByNumber(projectName, number)
+	if os.IsNotExist(err) {
+		apiError(w, 404, "not found")
+		return
+	}
+	if err != nil {
+		apiError(w, 500, err.Error())
+		return
+	}
+	info, err := storage.Info(projectName, r.Branch, r.Version)
+	if err != nil && !os.IsNotExist(err) {
+		apiError(w, 500, err.Error())
+		return
+	}
+	if info != nil && info.Number != number {
+		// The version was rebuilt later, and this build's results are gone.
+		apiResponse(w, 410, map[string]interface{}{
+			"number":     r.Number,
+			"branch":     r.Branch,
+			"version":    r.Version,
+			"replacedBy": info.Number,
+			"error":      "the version was rebuilt, this build's results are gone",
+		})
+		return
+	}
+	files, err := storage.Builds(projectName, r.Branch, r.Version)
+	if err != nil && !os.IsNotExist(err) {
+		apiError(w, 500, err.Error())
+		return
+	}
+	apiResponse(w, 200, map[string]interface{}{
+		"number":  r.Number,
+		"branch":  r.Branch,
+		"version": r.Version,
+		"info":    info,
+		"files":   files,
+	})
+}
+
+// buildRequestBody is the body of a build request.
+// Exactly one of Branch and Tag must be set.
+type buildRequestBody struct {
+	Branch string            `json:"branch"`
+	Tag    string            `json:"tag"`
+	Env    map[string]string `json:"env"`
+}
+
+// requestBuild queues a build of the given project. The request may only
+// override the variables the project allows.
+func requestBuild(w http.ResponseWriter, r *http.Request, projectName string) {
+	if stopping() {
+		apiError(w, 503, "shutting down")
+		return
+	}
+	var body buildRequestBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		apiError(w, 400, "invalid request body: "+err.Error())
+		return
+	}
+	if (body.Branch == "") == (body.Tag == "") {
+		apiError(w, 400, "either branch or tag must be given")
+		return
+	}
+	name := body.Branch + body.Tag
+	if !validRefName(name) {
+		apiError(w, 400, fmt.Sprintf("invalid ref name: %q", name))
+		return
+	}
+	if body.Branch != "" && reservedBranch(body.Branch) {
+		apiError(w, 400, fmt.Sprintf("branch %s can't be built, the name is taken by releases", body.Branch))
+		return
+	}
+
+	projects, err := storage.Projects()
+	if err != nil {
+		apiError(w, 500, err.Error())
+		return
+	}
+	var project *storage.Project
+	for i := range projects {
+		if projects[i].Name == projectName {
+			project = &projects[i]
+		}
+	}
+	if project == nil {
+		apiError(w, 404, fmt.Sprintf("no project %s", projectName))
+		return
+	}
+	for name := range body.Env {
+		if !matchesAny(project.Overrides, name) {
+			apiError(w, 400, fmt.Sprintf("variable %s may not be overridden in %s", name, projectName))
+			return
+		}
+	}
+
+	req := buildRequest{
+		project:   projectName,
+		ref:       ref{name: body.Branch},
+		env:       toEnvList(body.Env),
+		requested: true,
+	}
+	if body.Tag != "" {
+		req.ref = ref{name: body.Tag, isTag: true}
+	}
+
+	// Only refs the remote had at the last update can be built.
+	refs, err := storage.RemoteRefs(projectName)
+	if err != nil {
+		apiError(w, 500, err.Error())
+		return
+	}
+	if _, ok := refs[req.ref.fullName()]; !ok {
+		apiError(w, 404, fmt.Sprintf("no %s in %s", req.ref, projectName))
+		return
+	}
+	queue.push(req)
+	apiResponse(w, 202, map[string]interface{}{
+		"queued": queue.len(),
+	})
+}
+
+// withToken passes requests to the handler only if they have the API token
+// from the server config. Without a token in the config, the handler
+// is disabled.
+func withToken(h func(w http.ResponseWriter, r *http.Request, p params)) func(w http.ResponseWriter, r *http.Request, p params) {
+	return func(w http.ResponseWriter, r *http.Request, p params) {
+		srv, err := loadServerConfig()
+		if err != nil {
+			apiError(w, 500, err.Error())
+			return
+		}
+		if srv.APIToken == "" {
+			apiError(w, 403, "the API is read-only, there is no apiToken in the server config")
+			return
+		}
+		if !validToken(r, srv.APIToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, 401, "a valid API token is required")
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+// validToken returns true if the request has the given token
+// in its Authorization header.
+func validToken(r *http.Request, token string) bool {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(h, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func apiResponse(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	apiResponse(w, status, map[string]string{
+		"error": message,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestBuild(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"server.json":               `{"apiToken": "t0ken"}`,
+		"projects/app/project.json": `{"overrides": ["RPC", "FEATURE_*"]}`,
+		"projects/app/remote-refs":  "a1\trefs/heads/master\nb2\trefs/tags/1.0.0\nc3\trefs/heads/-x\nd4\trefs/heads/releases\n",
+	})
+	tests := []struct {
+		name   string
+		auth   string
+		body   string
+		status int
+	}{
+		{"no token", "", `{"branch": "master"}`, 401},
+		{"wrong token", "Bearer nope", `{"branch": "master"}`, 401},
+		{"no scheme", "t0ken", `{"branch": "master"}`, 401},
+		{"another scheme", "Basic t0ken", `{"branch": "master"}`, 401},
+		// The token is checked before the request is looked at.
+		{"bad body without token", "", `{`, 401},
+		{"no ref", "Bearer t0ken", `{}`, 400},
+		{"both refs", "Bearer t0ken", `{"branch": "master", "tag": "1.0.0"}`, 400},
+		{"disallowed variable", "Bearer t0ken", `{"branch": "master", "env": {"LD_PRELOAD": "/tmp/x.so"}}`, 400},
+		{"allowed variables", "Bearer t0ken", `{"branch": "master", "env": {"RPC": "x", "FEATURE_A": "1"}}`, 202},
+		{"no overrides", "Bearer t0ken", `{"tag": "1.0.0"}`, 202},
+		{"unknown branch", "Bearer t0ken", `{"branch": "develop"}`, 404},
+		{"tag given as a branch", "Bearer t0ken", `{"branch": "1.0.0"}`, 404},
+		{"option", "Bearer t0ken", `{"branch": "-x"}`, 400},
+		{"option tag", "Bearer t0ken", `{"tag": "--upload-pack=touch /tmp/x"}`, 400},
+		{"dots", "Bearer t0ken", `{"branch": "../master"}`, 400},
+		{"control character", "Bearer t0ken", `{"branch": "mas\u0000ter"}`, 400},
+		{"branch named like releases", "Bearer t0ken", `{"branch": "releases"}`, 400},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/projects/app/builds", strings.NewReader(tt.body))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body.String())
+		}
+	}
+
+	reqs := queue.take("app")
+	if len(reqs) != 2 {
+		t.Fatalf("%d requests queued, want 2", len(reqs))
+	}
+	if !reqs[0].requested || strings.Join(reqs[0].env, " ") != "FEATURE_A=1 RPC=x" {
+		t.Errorf("queued request: %+v", reqs[0])
+	}
+}
+
+func TestRequestBuildWithoutToken(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/app/project.json": `{}`,
+	})
+	r := httptest.NewRequest("POST", "/api/projects/app/builds", strings.NewReader(`{"branch": "master"}`))
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", w.Code)
+	}
+}
+
+// Handlers behind withToken are reached only with the right token.
+func TestWithToken(t *testing.T) {
+	inTempDir(t)
+	called := 0
+	h := withToken(func(w http.ResponseWriter, r *http.Request, p params) {
+		called++
+		w.WriteHeader(204)
+	})
+	call := func(auth string) int {
+		r := httptest.NewRequest("POST", "/api/x", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		return w.Code
+	}
+
+	for _, auth := range []string{"", "Bearer ", "Bearer x"} {
+		if code := call(auth); code != 403 {
+			t.Errorf("%q without a token in the config: %d, want 403", auth, code)
+		}
+	}
+	writeFiles(t, map[string]string{"server.json": `{"apiToken": "t0ken"}`})
+	for _, auth := range []string{"", "Bearer ", "Bearer t0ke", "Bearer t0ken2", "t0ken", "bearer t0ken"} {
+		if code := call(auth); code != 401 {
+			t.Errorf("%q: %d, want 401", auth, code)
+		}
+	}
+	if called != 0 {
+		t.Fatalf("the handler was called %d times without the token", called)
+	}
+	if code := call("Bearer t0ken"); code != 204 || called != 1 {
+		t.Errorf("with the token: %d, handler called %d times", code, called)
+	}
+}
+
+func TestShowReplacedBuild(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/app/buildnumbers":                   "1\tmaster\t1.0.0\n2\tmaster\t1.0.0\n",
+		"projects/app/builds/master/1.0.0/build.json": `{"number": 2, "status": "ok"}`,
+		"projects/app/builds/master/1.0.0/app.apk":    "apk",
+	})
+	tests := []struct {
+		path   string
+		status int
+		files  bool
+	}{
+		{"/api/projects/app/builds/1", 410, false},
+		{"/api/projects/app/builds/2", 200, true},
+		{"/api/projects/app/builds/3", 404, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if has := strings.Contains(w.Body.String(), "app.apk"); has != tt.files {
+			t.Errorf("%s: files listed: %v, want %v: %s", tt.path, has, tt.files, w.Body.String())
+		}
+	}
+}
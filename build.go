@@ -1,12 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gaswelder/butler/builders"
@@ -14,208 +15,579 @@ import (
 )
 
 // trackUpdates continuously updates the projects directory
-// and makes new builds.
+// and makes new builds until butler is shutting down.
 func trackUpdates() {
+	defer close(loopDone)
 	for {
+		updates.beat()
 		projects, err := storage.Projects()
 		if err != nil {
 			// If something went wrong while trying to get the list of
 			// projects, wait a little before trying again.
-			log.Printf("failed to get projects list: %v", err)
-			time.Sleep(60 * time.Second)
+			slog.Error("failed to get projects list", "err", err)
+			if !pause(60 * time.Second) {
+				return
+			}
 			continue
 		}
 
 		for _, project := range projects {
+			if stopping() {
+				return
+			}
+			if !updates.due(project.Name) {
+				continue
+			}
+			updates.beat()
 			err := update(project)
+			updates.record(project.Name, project.PollInterval, err)
+			measureDiskUsage(project.Name)
+			// The project waits before the next attempt, the others don't.
 			if err != nil {
-				log.Printf("failed to update %s: %v", project, err)
-				time.Sleep(60 * time.Second)
-				continue
+				slog.Error("failed to update", "project", project.Name, "err", err)
 			}
 		}
 
 		// Sleep a while and repeat the whole thing again.
-		time.Sleep(10 * time.Second)
+		if !pause(10 * time.Second) {
+			return
+		}
 	}
 }
 
 // update updates all builds for the given project.
 func update(project storage.Project) error {
-	sourceDir := storage.SourcePath(project.Name)
-
-	g := git{sourceDir: sourceDir}
+	// Git output goes to the project's own log, so that output of different
+	// projects doesn't mix up.
+	gitLog, err := storage.UpdateLog(project.Name)
+	if err != nil {
+		return err
+	}
+	defer gitLog.Close()
+	g, err := remoteGit(project, gitLog)
+	if err != nil {
+		return fmt.Errorf("failed to set up credentials: %v", err)
+	}
 
 	// Update the source.
-	err := g.fetch()
+	err = prepareSource(project, g)
 	if err != nil {
+		fetchFailures.inc(project.Name)
 		return err
 	}
 
-	// Build tips of all branches, but also build the latest clean tag.
-	branches, err := g.branches()
+	// Asking the remote for its refs is much cheaper than fetching,
+	// so only the refs that have moved since the last update are
+	// fetched and looked at.
+	remote, err := g.remoteRefs()
 	if err != nil {
+		fetchFailures.inc(project.Name)
 		return err
 	}
-	tags, err := g.tags()
+	seen, err := storage.RemoteRefs(project.Name)
 	if err != nil {
-		return fmt.Errorf("couldn't get tags list: %v", err)
+		return err
+	}
+	err = forgetDeleted(project, seen)
+	if err != nil {
+		return err
+	}
+	moved := func(name string) bool {
+		return seen[name] != remote[name]
+	}
+	changed := make([]string, 0)
+	for name := range remote {
+		if moved(name) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range seen {
+		if _, ok := remote[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		return buildRequested(project, g)
+	}
+	err = g.fetch(remote, changed)
+	if err != nil {
+		fetchFailures.inc(project.Name)
+		return err
 	}
 
-	if len(tags) > 0 {
-		tag := tags[len(tags)-1]
-		if !storage.Has(project.Name, storage.ReleasesDirectory, tag) {
-			log.Printf("%s: building %s", project.Name, tag)
-			// Builds on previous branches might change the source tree, so
-			// we have to do a reset.
-			err = g.discard()
-			if err != nil {
-				return err
+	// The snapshot is saved with the refs that have been dealt with,
+	// so that the ones skipped because of shutdown or an error
+	// are looked at again next time.
+	done := make(map[string]string)
+	for name, hash := range seen {
+		if _, ok := remote[name]; ok {
+			done[name] = hash
+		}
+	}
+	defer func() {
+		err := storage.SaveRemoteRefs(project.Name, done)
+		if err != nil {
+			slog.Error("failed to save remote refs", "project", project.Name, "err", err)
+		}
+	}()
+
+	// Build tips of all branches, but also build the latest clean tag.
+	// A deleted tag counts too, since it can be the one the branches
+	// were described by.
+	tagsMoved := false
+	for _, name := range changed {
+		if strings.HasPrefix(name, "refs/tags/") {
+			tagsMoved = true
+		}
+	}
+	if tagsMoved {
+		tags, err := g.tags()
+		if err != nil {
+			return fmt.Errorf("couldn't get tags list: %v", err)
+		}
+		if len(tags) > 0 {
+			tag := tags[len(tags)-1]
+			if !storage.Has(project.Name, storage.ReleasesDirectory, tag) && !stopping() {
+				slog.Debug("building", "project", project.Name, "tag", tag)
+				r := ref{name: tag, isTag: true}
+				err = checkout(g, r)
+				if err != nil {
+					return err
+				}
+				err = build(project, r, tag, nil)
+				if err != nil {
+					slog.Error("tag build failed", "project", project.Name, "tag", tag, "err", err)
+				} else {
+					queueDownstream(project.Name, r, tag, nil)
+				}
+			}
+		}
+		if !stopping() {
+			for name, hash := range remote {
+				if strings.HasPrefix(name, "refs/tags/") {
+					done[name] = hash
+				}
 			}
-			err = g.checkout(tag)
+		}
+	}
+
+	branches, err := g.branches()
+	if err != nil {
+		return err
+	}
+	for _, name := range branches {
+		if stopping() {
+			return nil
+		}
+		key := "refs/heads/" + name
+		// A new tag can change the versions of branches that haven't moved.
+		if !tagsMoved && !moved(key) {
+			continue
+		}
+		desc, err := g.describe("origin/" + name)
+		if err != nil {
+			return err
+		}
+		if !storage.Has(project.Name, name, desc) {
+			slog.Debug("building", "project", project.Name, "branch", name, "version", desc)
+			r := ref{name: name}
+			err = checkout(g, r)
 			if err != nil {
 				return err
 			}
-			err = build(project, storage.ReleasesDirectory, tag)
+			err = build(project, r, desc, nil)
 			if err != nil {
-				log.Printf("tag build failed: %v", err)
+				slog.Error("branch build failed", "project", project.Name, "branch", name, "version", desc, "err", err)
+			} else {
+				queueDownstream(project.Name, r, desc, nil)
 			}
 		}
+		if !stopping() {
+			done[key] = remote[key]
+		}
+	}
+	// Branches that are not built only need to be remembered.
+	buildable := make(map[string]bool)
+	for _, name := range branches {
+		buildable["refs/heads/"+name] = true
+	}
+	for name, hash := range remote {
+		if strings.HasPrefix(name, "refs/heads/") && !buildable[name] {
+			done[name] = hash
+		}
 	}
 
-	for _, branch := range branches {
-		if !storage.Has(project.Name, branch.name, branch.desc) {
-			log.Printf("%s: building %s %s", project.Name, branch, branch.desc)
-			// Builds on previous branches might change the source tree, so
-			// we have to do a reset.
-			err = g.discard()
-			if err != nil {
-				return err
+	return buildRequested(project, g)
+}
+
+// forgetDeleted drops from the snapshot of the remote refs the branches
+// and tags that have no builds in the store, so that their builds are made
+// again if the store has been wiped. Failed builds are stored too, so
+// this doesn't repeat them.
+func forgetDeleted(project storage.Project, seen map[string]string) error {
+	stored, err := storage.Branches(project.Name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	has := make(map[string]bool)
+	for _, name := range stored {
+		has[name] = true
+	}
+	defaultBranch := ""
+	if project.Remote != nil {
+		defaultBranch = project.Remote.Branch
+	}
+	for name := range seen {
+		if branch := strings.TrimPrefix(name, "refs/heads/"); branch != name {
+			if branchIsBuildable(branch, defaultBranch) && !has[branch] {
+				delete(seen, name)
 			}
-			err = g.checkout(branch.name)
-			if err != nil {
-				return err
+		}
+		if tag := strings.TrimPrefix(name, "refs/tags/"); tag != name {
+			if versionTag.MatchString(tag) && !has[storage.ReleasesDirectory] {
+				delete(seen, name)
 			}
+		}
+	}
+	return nil
+}
 
-			err = g.pull()
+// buildRequested makes the builds of the project that were requested explicitly.
+func buildRequested(project storage.Project, g git) error {
+	for _, req := range queue.take(project.Name) {
+		if stopping() {
+			return nil
+		}
+		if !req.ref.isTag && reservedBranch(req.ref.name) {
+			slog.Warn("not building a branch named like the releases", "project", project.Name, req.ref.attr())
+			continue
+		}
+		slog.Debug("building on request", "project", project.Name, req.ref.attr())
+		err := checkout(g, req.ref)
+		if err != nil {
+			slog.Error("failed to check out", "project", project.Name, req.ref.attr(), "err", err)
+			continue
+		}
+		version := req.ref.name
+		if !req.ref.isTag {
+			version, err = g.describe("HEAD")
 			if err != nil {
 				return err
 			}
-			err = build(project, branch.name, branch.desc)
-			if err != nil {
-				log.Printf("branch build failed: %v", err)
-			}
+		}
+		if req.requested {
+			version = storage.RequestedVersion(project.Name, req.ref.directory(), version)
+		}
+		err = build(project, req.ref, version, &req)
+		if err != nil {
+			slog.Error("requested build failed", "project", project.Name, req.ref.attr(), "version", version, "err", err)
+		} else {
+			queueDownstream(project.Name, req.ref, version, req.chain)
 		}
 	}
 
 	return nil
 }
 
-func build(project storage.Project, directory, version string) error {
-	var err error
-
-	sourceDir := storage.SourcePath(project.Name)
-	logger, err := storage.BuildLogger(project.Name, directory, version)
+// checkout resets the source tree and checks out the given ref.
+func checkout(g git, r ref) error {
+	// Builds on previous branches might change the source tree, so
+	// we have to do a reset.
+	err := g.discard()
 	if err != nil {
 		return err
 	}
-	files, err := runBuilds(sourceDir, logger, project.Env)
-	logger.Close()
-	if err != nil {
-		return fmt.Errorf("build failed: %v", err)
+	err = g.checkout(r.name)
+	if err != nil || r.isTag {
+		return err
 	}
+	return g.pull()
+}
 
-	err = storage.SaveBuilds(project.Name, directory, version, files)
-	if err != nil {
-		return fmt.Errorf("failed to save builds: %v", err)
+// ref identifies what is being built: a branch tip or a tag.
+type ref struct {
+	name  string
+	isTag bool
+}
+
+// directory returns the name of the builds directory for the ref.
+func (r ref) directory() string {
+	if r.isTag {
+		return storage.ReleasesDirectory
 	}
-	log.Printf("%s: saved %v", project, files)
-	return nil
+	return r.name
 }
 
-type versionConfig struct {
-	Env map[string]string `json:"env"`
+// fullName returns the full name of the ref, like "refs/heads/master".
+func (r ref) fullName() string {
+	if r.isTag {
+		return "refs/tags/" + r.name
+	}
+	return "refs/heads/" + r.name
 }
 
-type sourceConfig struct {
-	Versions map[string]versionConfig `json:"versions"`
+// parseRef returns the ref with the given full name.
+func parseRef(fullName string) (ref, bool) {
+	if name := strings.TrimPrefix(fullName, "refs/heads/"); name != fullName && name != "" {
+		return ref{name: name}, true
+	}
+	if name := strings.TrimPrefix(fullName, "refs/tags/"); name != fullName && name != "" {
+		return ref{name: name, isTag: true}, true
+	}
+	return ref{}, false
 }
 
-func config(sourceDir string) (*sourceConfig, error) {
-	cfg := &sourceConfig{
-		Versions: map[string]versionConfig{
-			"dev": {
-				Env: map[string]string{
-					"BUTLER_ENV": "dev",
-				},
-			},
-		},
+func (r ref) String() string {
+	if r.isTag {
+		return "tag " + r.name
 	}
+	return "branch " + r.name
+}
 
-	// Read butler.json. If no such file, return the default config.
-	data, err := ioutil.ReadFile(sourceDir + "/butler.json")
-	if os.IsNotExist(err) {
-		return cfg, nil
+// build builds the checked out source of the given ref and saves the results
+// as the given version. If the build was requested explicitly or triggered
+// by an upstream project, req is the request, otherwise it's nil.
+func build(project storage.Project, r ref, version string, req *buildRequest) error {
+	var err error
+	var overrides []string
+	var trigger *upstreamBuild
+	if req != nil {
+		overrides = req.env
+		trigger = req.upstream
 	}
+
+	directory := r.directory()
+	sourceDir := storage.SourcePath(project.Name)
+	srv, err := loadServerConfig()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	secrets, err := storage.Secrets(project.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets: %v", err)
 	}
+	values := make([]string, 0, len(secrets))
+	for _, v := range secrets {
+		values = append(values, v)
+	}
+	meta, err := readMeta(projectGit(project, nil), project.Name, r, version)
+	if err != nil {
+		return fmt.Errorf("failed to get build info: %v", err)
+	}
+	origin := storage.Origin{Ref: r.fullName()}
+	if req != nil {
+		origin.Requested = req.requested
+	}
+	logger, err := storage.BuildLogger(project.Name, directory, version, origin, values)
+	if err != nil {
+		return err
+	}
+	rb := runningBuild{
+		Project: project.Name,
+		Ref:     r,
+		Version: version,
+		Number:  meta.number,
+		Started: time.Now(),
+	}
+	running.start(rb)
+	defer running.finish(rb)
+	l := slog.With("project", project.Name, r.attr(), "version", version, "build", meta.number)
+	l.Info("build started")
 
-	err = json.Unmarshal(data, cfg)
+	env := &environment{}
+	env.add(sourceHost, srv.HostEnv.filter(os.Environ()))
+	env.add(sourceServer, toEnvList(srv.Env))
+	env.add(sourceProject, project.Env)
+	env.add(sourceSecrets, toEnvList(buildSecrets(project, secrets)))
+	// Upstream builds downloaded for this build are removed after it.
+	upstreamDir := "tmp/upstream/" + project.Name + "-" + strconv.Itoa(meta.number)
+	defer os.RemoveAll(upstreamDir)
+	env.add(sourceUpstream, upstreamEnv(project, trigger, upstreamDir))
+	info := &storage.BuildInfo{
+		Number:  meta.number,
+		Commit:  meta.commit,
+		Author:  meta.author,
+		Message: meta.message,
+		Started: time.Now(),
+	}
+	if req != nil {
+		info.Requested = req.requested
+	}
+	cells, files, err := runBuilds(sourceDir, r, logger, env, meta, overrides)
+	logger.Close()
+	if buildCtx.Err() != nil {
+		// Killed on shutdown. The build stays in the staging directory
+		// and is recovered on the next start.
+		l.Warn("build killed")
+		return fmt.Errorf("build killed")
+	}
+	if err != nil {
+		err = fmt.Errorf("build failed: %v", err)
+	} else {
+		// Save whatever the successful cells produced even if others failed.
+		err = storage.SaveBuilds(project.Name, directory, version, files)
+		if err != nil {
+			err = fmt.Errorf("failed to save builds: %v", err)
+		} else {
+			l.Info("saved build files", "count", len(files))
+		}
+	}
+
+	info.Finished = time.Now()
+	info.Cells = cells
+	info.Status = matrixStatus(cells, err)
+	if info.Status == storage.StatusSkipped {
+		// Not a failure, but there's nothing to serve or trigger on.
+		err = fmt.Errorf("nothing to build: no variants apply to %s", r)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse butler.json: %v", err)
+		info.Error = err.Error()
 	}
-	return cfg, nil
+	failed := 0
+	for _, c := range cells {
+		if c.Status == storage.StatusFailed {
+			failed++
+		}
+	}
+	buildsTotal.inc(project.Name, info.Status)
+	l.Info("build finished", "status", info.Status, "duration", info.Finished.Sub(info.Started).Round(time.Second).String())
+
+	// Failed builds are saved too, so that they are not repeated
+	// on every update.
+	saveErr := storage.SaveInfo(project.Name, directory, version, info)
+	if saveErr == nil {
+		saveErr = storage.Commit(project.Name, directory, version)
+	}
+	if saveErr != nil {
+		return fmt.Errorf("failed to save build: %v", saveErr)
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d builds failed", failed, len(cells))
+	}
+	return nil
 }
 
-func toEnvList(vars map[string]string) []string {
-	list := make([]string, 0)
-	for k, v := range vars {
-		list = append(list, k+"="+v)
+// matrixStatus returns the status of a build with the given cells: failed
+// if it couldn't be run or any cell didn't succeed, skipped if there were
+// no cells to run, and ok otherwise.
+func matrixStatus(cells []storage.Cell, err error) string {
+	if err != nil {
+		return storage.StatusFailed
+	}
+	if len(cells) == 0 {
+		return storage.StatusSkipped
 	}
-	return list
+	for _, c := range cells {
+		if c.Status != storage.StatusOK {
+			return storage.StatusFailed
+		}
+	}
+	return storage.StatusOK
 }
 
-// runBuilds builds everything in the given source directory and returns
-// a list of build outputs.
-func runBuilds(sourceDir string, logger io.Writer, env []string) ([]string, error) {
+// runBuilds builds everything in the given source directory. Every builder
+// is run once for every variant that applies to the ref, and the result of
+// each run is returned as a separate cell along with the list of all build
+// outputs. Each run gets the given environment with the variant's variables,
+// the build's BUTLER_* variables and the overrides on top.
+// An error is returned only if the builds couldn't be started at all.
+func runBuilds(sourceDir string, r ref, logger io.Writer, env *environment, meta buildMeta, overrides []string) ([]storage.Cell, []storage.Artifact, error) {
 	// Get builders for this project.
 	bs, err := detectBuilders(sourceDir)
 	if err != nil {
-		return nil, fmt.Errorf("could not get project builders: %s", err.Error())
+		return nil, nil, fmt.Errorf("could not get project builders: %s", err.Error())
 	}
 	if len(bs) == 0 {
-		return nil, fmt.Errorf("no builders detected")
+		return nil, nil, fmt.Errorf("no builders detected")
 	}
 	for _, builder := range bs {
-		log.Printf("%s -> %s", builder.Dirname(), builder.Name())
+		fmt.Fprintf(logger, "%s -> %s\n", builder.Dirname(), builder.Name())
 	}
 
 	cfg, err := config(sourceDir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	variants := cfg.Versions.forRef(r)
+	if len(variants) == 0 {
+		fmt.Fprintf(logger, "no variants apply to %s\n", r)
 	}
 
-	allFiles := make([]string, 0)
+	cells := make([]storage.Cell, 0)
+	allFiles := make([]storage.Artifact, 0)
+	failed := false
 	for _, builder := range bs {
-		for envName, versionCfg := range cfg.Versions {
-			// Combine all environment variables in one list.
-			versionEnv := append(os.Environ(), env...)
-			versionEnv = append(versionEnv, toEnvList(versionCfg.Env)...)
+		for _, v := range variants {
+			cell := storage.Cell{
+				Builder: builder.Name(),
+				Dir:     builderDir(sourceDir, builder),
+				Variant: v.name,
+				Files:   []string{},
+			}
+			if failed && !cfg.KeepGoing {
+				cell.Status = storage.StatusSkipped
+				cells = append(cells, cell)
+				continue
+			}
 
-			files, err := builder.Build(logger, versionEnv)
+			cellEnv := env.with(sourceVariant, toEnvList(v.Env)).
+				with(sourceButler, meta.env(v.name)).
+				with(sourceOverride, overrides)
+			cell.Env = cellEnv.record()
+
+			fmt.Fprintf(logger, "\n=== %s (%s), %s ===\n", cell.Builder, cell.Dir, cell.Variant)
+			cell.Started = time.Now()
+			files, err := runCell(builder, logger, cellEnv.list(), v.name)
+			cell.Duration = time.Since(cell.Started)
+			buildDuration.observe(cell.Duration.Seconds(), cell.Builder)
 			if err != nil {
-				return nil, err
+				failed = true
+				cell.Status = storage.StatusFailed
+				cell.Error = err.Error()
+				fmt.Fprintf(logger, "\n=== %s (%s), %s: failed: %v ===\n", cell.Builder, cell.Dir, cell.Variant, err)
+				cells = append(cells, cell)
+				continue
 			}
-			// stash the files somewhere before they get deleted by the next build.
-			s, err := storage.Stash(files, envName)
-			if err != nil {
-				return nil, err
+			fmt.Fprintf(logger, "\n=== %s (%s), %s: ok ===\n", cell.Builder, cell.Dir, cell.Variant)
+			cell.Status = storage.StatusOK
+			for _, f := range files {
+				cell.Files = append(cell.Files, path.Base(f))
+				allFiles = append(allFiles, storage.Artifact{
+					Path:    f,
+					Builder: cell.Builder,
+					Dir:     cell.Dir,
+					Variant: cell.Variant,
+				})
 			}
-			allFiles = append(allFiles, s...)
+			cells = append(cells, cell)
 		}
 	}
-	return allFiles, nil
+	return cells, allFiles, nil
+}
+
+// runCell runs one builder with one variant's environment and returns
+// the stashed build outputs.
+func runCell(builder builders.Builder, logger io.Writer, env []string, envName string) ([]string, error) {
+	files, err := builder.Build(buildCtx, logger, env)
+	if err != nil {
+		return nil, err
+	}
+	// stash the files somewhere before they get deleted by the next build.
+	return storage.Stash(files, envName)
+}
+
+// builderDir returns the builder's directory relative to the source root.
+func builderDir(sourceDir string, builder builders.Builder) string {
+	dir := strings.TrimPrefix(builder.Dirname(), sourceDir)
+	dir = strings.TrimPrefix(dir, "/")
+	if dir == "" {
+		return "."
+	}
+	return dir
 }
 
 // detectBuilders returns a list of builders needed for the given source directory.
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// Refs whose builds are gone from the store are looked at again,
+// and the rest are left alone.
+func TestForgetDeleted(t *testing.T) {
+	inTempDir(t)
+	project := storage.Project{Name: "app", Remote: &storage.Remote{Branch: "main"}}
+	refs := func() map[string]string {
+		return map[string]string{
+			"refs/heads/master":     "1",
+			"refs/heads/main":       "2",
+			"refs/heads/feature":    "3",
+			"refs/tags/1.0.0":       "4",
+			"refs/tags/nightly":     "5",
+			"refs/heads/dev-failed": "6",
+		}
+	}
+
+	// Nothing has been built.
+	seen := refs()
+	if err := forgetDeleted(project, seen); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"refs/heads/feature": "3", "refs/tags/nightly": "5"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("got %v, want %v", seen, want)
+	}
+
+	// Failed builds are stored too, so they are not repeated.
+	writeFiles(t, map[string]string{
+		"projects/app/builds/master/1.0.0-1-gabcdef0/build.json":     "{}",
+		"projects/app/builds/main/1.0.0-2-gabcdef0/build.json":       "{}",
+		"projects/app/builds/dev-failed/1.0.0-3-gabcdef0/build.json": `{"status": "failed"}`,
+		"projects/app/builds/releases/1.0.0/build.json":              "{}",
+	})
+	seen = refs()
+	if err := forgetDeleted(project, seen); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, refs()) {
+		t.Errorf("got %v, want %v", seen, refs())
+	}
+}
+
+// matrixSource writes a project built by a script that makes a file
+// named after the variant and fails for the "bad" variant.
+func matrixSource(t *testing.T, config string) string {
+	t.Helper()
+	writeFiles(t, map[string]string{
+		"src/butler.json": config,
+		"src/butler.sh": "#!/bin/sh\n" +
+			"if [ \"$BUTLER_VARIANT\" = bad ]; then exit 1; fi\n" +
+			"echo \"$GREETING\" > \"$1/$BUTLER_VARIANT.txt\"\n",
+	})
+	if err := os.Chmod("src/butler.sh", 0777); err != nil {
+		t.Fatal(err)
+	}
+	return "src"
+}
+
+func TestRunBuildsMatrix(t *testing.T) {
+	versions := `"versions": {
+		"a": {"env": {"GREETING": "hi"}},
+		"bad": {},
+		"c": {"branches": ["dev*"]},
+		"release": {"tags": ["*"]}
+	}`
+	tests := []struct {
+		config   string
+		ref      ref
+		statuses []string
+		files    []string
+	}{
+		{`{` + versions + `}`, ref{name: "develop"},
+			[]string{"a ok", "bad failed", "c skipped"}, []string{"a.txt"}},
+		{`{"keepGoing": true, ` + versions + `}`, ref{name: "develop"},
+			[]string{"a ok", "bad failed", "c ok"}, []string{"a.txt", "c.txt"}},
+		{`{"keepGoing": true, ` + versions + `}`, ref{name: "master"},
+			[]string{"a ok", "bad failed"}, []string{"a.txt"}},
+		{`{"keepGoing": true, ` + versions + `}`, ref{name: "1.0.0", isTag: true},
+			[]string{"a ok", "bad failed", "release ok"}, []string{"a.txt", "release.txt"}},
+	}
+	for _, tt := range tests {
+		inTempDir(t)
+		src := matrixSource(t, tt.config)
+		cells, files, err := runBuilds(src, tt.ref, ioutil.Discard, &environment{}, buildMeta{ref: tt.ref}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := make([]string, len(cells))
+		for i, c := range cells {
+			statuses[i] = c.Variant + " " + c.Status
+		}
+		if !reflect.DeepEqual(statuses, tt.statuses) {
+			t.Errorf("%s: cells %q, want %q", tt.ref, statuses, tt.statuses)
+		}
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = f.Variant + ".txt"
+			if path.Base(f.Path) != f.Variant+"-"+names[i] {
+				t.Errorf("%s: file %s of variant %s", tt.ref, f.Path, f.Variant)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.files) {
+			t.Errorf("%s: files %q, want %q", tt.ref, names, tt.files)
+		}
+	}
+}
+
+// A build with nothing to run is not shown as a successful one.
+func TestMatrixStatus(t *testing.T) {
+	ok := storage.Cell{Status: storage.StatusOK}
+	failed := storage.Cell{Status: storage.StatusFailed}
+	skipped := storage.Cell{Status: storage.StatusSkipped}
+	tests := []struct {
+		cells []storage.Cell
+		err   error
+		want  string
+	}{
+		{nil, nil, storage.StatusSkipped},
+		{[]storage.Cell{}, nil, storage.StatusSkipped},
+		{[]storage.Cell{ok, ok}, nil, storage.StatusOK},
+		{[]storage.Cell{ok, failed, skipped}, nil, storage.StatusFailed},
+		{[]storage.Cell{ok}, os.ErrNotExist, storage.StatusFailed},
+		{nil, os.ErrNotExist, storage.StatusFailed},
+	}
+	for i, tt := range tests {
+		if got := matrixStatus(tt.cells, tt.err); got != tt.want {
+			t.Errorf("%d: got %s, want %s", i, got, tt.want)
+		}
+	}
+}
+
+// A branch named like the releases directory is not built even when asked.
+func TestReservedBranchNotBuilt(t *testing.T) {
+	inTempDir(t)
+	queue.push(buildRequest{project: "app", ref: ref{name: storage.ReleasesDirectory}, requested: true})
+	queue.push(buildRequest{project: "app", ref: ref{name: storage.ReleasesDirectory}, upstream: &upstreamBuild{project: "lib"}})
+	// The requests are dropped before the source is touched.
+	err := buildRequested(storage.Project{Name: "app"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := queue.len(); n != 0 {
+		t.Errorf("%d requests left", n)
+	}
+}
+
+// A tag deleted on the remote changes the versions of the branches
+// it described, so they are built again.
+func TestUpdateDeletedTag(t *testing.T) {
+	bare, work := gitRepo(t)
+	if err := ioutil.WriteFile(work+"/README", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, work, "add", "README")
+	commit(t, work, "first")
+	runGit(t, work, "tag", "1.0.0")
+	head := commit(t, work, "second")
+	runGit(t, work, "tag", "1.1.0")
+	runGit(t, work, "push", "-q", "origin", "master", "--tags")
+	inTempDir(t)
+	writeFiles(t, map[string]string{"projects/app/project.json": `{}`})
+	project := storage.Project{Name: "app", Remote: &storage.Remote{URL: bare, Branch: "master"}}
+
+	if err := update(project); err != nil {
+		t.Fatal(err)
+	}
+	if !storage.Has("app", "master", "1.1.0") {
+		t.Fatal("master is not built")
+	}
+	runGit(t, work, "push", "-q", "origin", ":refs/tags/1.1.0")
+	if err := update(project); err != nil {
+		t.Fatal(err)
+	}
+	if version := "1.0.0-1-g" + head[:7]; !storage.Has("app", "master", version) {
+		t.Errorf("master is not built as %s", version)
+	}
+}
@@ -1,9 +1,9 @@
 package builders
 
 import (
+	"context"
 	"io"
 	"os"
-	"os/exec"
 	"strings"
 )
 
@@ -20,14 +20,14 @@ func Android(projectDir string) Builder {
 }
 
 // Build builds the project.
-func (a *AndroidBuilder) Build(output io.Writer, envVars []string) ([]string, error) {
+func (a *AndroidBuilder) Build(ctx context.Context, output io.Writer, envVars []string) ([]string, error) {
 	projectDir := a.projectDir
 
-	cmd := exec.Command("./gradlew", "build")
+	cmd := command(ctx, "./gradlew", "build")
 	cmd.Dir = projectDir
 	cmd.Stderr = output
 	cmd.Stdout = output
-	cmd.Env = append(envVars)
+	cmd.Env = envVars
 
 	err := cmd.Run()
 	if err != nil {
@@ -1,6 +1,7 @@
 package builders
 
 import (
+	"context"
 	"io"
 	"os"
 )
@@ -8,7 +9,8 @@ import (
 // Builder represents a builder object for a particular kind of project.
 type Builder interface {
 	// Build performs a build and returns a list of output file paths.
-	Build(output io.Writer, envVars []string) ([]string, error)
+	// Canceling the context kills the build.
+	Build(ctx context.Context, output io.Writer, envVars []string) ([]string, error)
 
 	// Dirname returns the builder's project path.
 	Dirname() string
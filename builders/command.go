@@ -0,0 +1,17 @@
+package builders
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// command returns a command that is killed along with all the processes
+// it started, like Gradle daemons, when the context is canceled.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	killGroup(cmd)
+	// Don't wait forever for output of children that survived the kill.
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
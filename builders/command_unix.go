@@ -0,0 +1,17 @@
+//go:build !windows
+
+package builders
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup makes the command run in its own process group
+// and get the whole group killed on cancel.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
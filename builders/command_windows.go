@@ -0,0 +1,5 @@
+package builders
+
+import "os/exec"
+
+func killGroup(cmd *exec.Cmd) {}
@@ -1,16 +1,16 @@
 package builders
 
 import (
+	"context"
 	"io"
 	"os"
-	"os/exec"
 )
 
-func npm(sourceDir string, output io.Writer) error {
+func npm(ctx context.Context, sourceDir string, output io.Writer) error {
 	// Use NPM by default. But if yarn.lock exists, use Yarn.
-	cmd := exec.Command("npm", "install")
+	cmd := command(ctx, "npm", "install")
 	if exists(sourceDir + "/yarn.lock") {
-		cmd = exec.Command("yarn")
+		cmd = command(ctx, "yarn")
 	}
 	cmd.Dir = sourceDir
 	cmd.Stderr = output
@@ -1,6 +1,9 @@
 package builders
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 // ReactNativeBuilder is a buider for React Native projects.
 type ReactNativeBuilder struct {
@@ -17,13 +20,13 @@ func ReactNative(projectDir string) Builder {
 }
 
 // Build builds the project.
-func (b *ReactNativeBuilder) Build(output io.Writer, envVars []string) ([]string, error) {
+func (b *ReactNativeBuilder) Build(ctx context.Context, output io.Writer, envVars []string) ([]string, error) {
 	var err error
-	err = npm(b.projectDir, output)
+	err = npm(ctx, b.projectDir, output)
 	if err != nil {
 		return nil, err
 	}
-	paths, err := b.android.Build(output, envVars)
+	paths, err := b.android.Build(ctx, output, envVars)
 	return paths, err
 }
 
@@ -1,10 +1,10 @@
 package builders
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 )
 
 // ScriptBuilder is a builder calling a custom script.
@@ -20,7 +20,7 @@ func Script(projectDir string) Builder {
 }
 
 // Build builds the project.
-func (b *ScriptBuilder) Build(output io.Writer, envVars []string) ([]string, error) {
+func (b *ScriptBuilder) Build(ctx context.Context, output io.Writer, envVars []string) ([]string, error) {
 	err := os.MkdirAll("./tmp/scriptbuilder", 0777)
 	if err != nil {
 		return nil, err
@@ -35,7 +35,7 @@ func (b *ScriptBuilder) Build(output io.Writer, envVars []string) ([]string, err
 		return nil, err
 	}
 
-	cmd := exec.Command("./butler.sh", tmpDir)
+	cmd := command(ctx, "./butler.sh", tmpDir)
 	cmd.Dir = b.projectDir
 	cmd.Stdout = output
 	cmd.Stderr = output
@@ -1,7 +1,91 @@
 package main
 
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
 func main() {
-	go trackUpdates()
+	if os.Getenv(askpassVar) != "" && len(os.Args) == 2 {
+		// Run by git to get credentials.
+		askpass(os.Args[1])
+		return
+	}
+	if len(os.Args) > 1 {
+		err := command(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	cfg, err := loadServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupLogging(cfg.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setupStorage(cfg)
+	err = setupGit(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Signals are caught from the start, so that a stop during the
+	// migrations still waits for them and doesn't kill butler midway.
+	// The shutdown then begins once they are done.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	// The server is started first to answer health checks while
+	// migrations are running.
 	go serveBuilds()
-	select {}
+	migrate()
+	recoverBuilds()
+	ready.Store(true)
+	go trackUpdates()
+
+	<-signals
+	timeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout > 0 {
+		timeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+	shutdown(timeout)
+}
+
+// migrate brings builds saved by older versions up to date.
+func migrate() {
+	for _, name := range routes.prefixes() {
+		if _, err := os.Stat("projects/" + name); err == nil {
+			slog.Warn("the project's name is taken by a page, so it's ignored; rename its directory", "project", name)
+		}
+	}
+	projects, err := storage.Projects()
+	if err != nil {
+		slog.Error("failed to get projects list", "err", err)
+		return
+	}
+	for _, p := range projects {
+		// Branches of the repository help to find where builds missing
+		// from the index belong. Without a clone, only the stored ones do.
+		branches, err := projectGit(p, nil).branches()
+		if err != nil {
+			branches = nil
+		}
+		n, err := storage.MigrateBranches(p.Name, branches)
+		if err != nil {
+			slog.Error("failed to migrate builds", "project", p.Name, "err", err)
+		}
+		if n > 0 {
+			slog.Info("moved builds to new branch directories", "project", p.Name, "count", n)
+		}
+	}
 }
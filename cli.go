@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+const usage = `usage:
+	butler                              run the build server
+	butler secrets <project>            list names of the project's secrets
+	butler secrets <project> set <name> set a secret, reading the value from stdin
+	butler secrets <project> rm <name>  delete a secret
+	butler build <project> branch|tag <name> [NAME=value...]
+	                                    ask the running server to build a branch or tag,
+	                                    optionally with additional environment variables
+	butler keygen                       create a key for signing build manifests
+
+The build command sends the request to http://localhost:8080 or to the
+address given in the BUTLER_URL environment variable, with the API token
+from the BUTLER_API_TOKEN environment variable.`
+
+// command runs a command given on the command line.
+func command(args []string) error {
+	switch args[0] {
+	case "secrets":
+		return secretsCommand(args[1:])
+	case "build":
+		return buildCommand(args[1:])
+	case "keygen":
+		pub, err := storage.GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("public key: %s\n", base64.StdEncoding.EncodeToString(pub))
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s\n%s", args[0], usage)
+	}
+}
+
+func secretsCommand(args []string) error {
+	if len(args) == 1 {
+		names, err := storage.SecretNames(args[0])
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if len(args) != 3 {
+		return fmt.Errorf("%s", usage)
+	}
+	project, action, name := args[0], args[1], args[2]
+	switch action {
+	case "set":
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && value == "" {
+			return fmt.Errorf("failed to read the value: %v", err)
+		}
+		return storage.SetSecret(project, name, strings.TrimRight(value, "\r\n"))
+	case "rm":
+		return storage.DeleteSecret(project, name)
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
+
+func buildCommand(args []string) error {
+	if len(args) < 3 || (args[1] != "branch" && args[1] != "tag") {
+		return fmt.Errorf("%s", usage)
+	}
+	body := buildRequestBody{
+		Env: make(map[string]string),
+	}
+	if args[1] == "branch" {
+		body.Branch = args[2]
+	} else {
+		body.Tag = args[2]
+	}
+	for _, v := range args[3:] {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid variable, expected NAME=value: %s", v)
+		}
+		body.Env[parts[0]] = parts[1]
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	base := os.Getenv("BUTLER_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	req, err := http.NewRequest("POST", base+"/api/projects/"+url.PathEscape(args[0])+"/builds", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("BUTLER_API_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.StatusCode != 202 {
+		return fmt.Errorf("build request failed: %v", result["error"])
+	}
+	fmt.Printf("queued, %v requests in the queue\n", result["queued"])
+	return nil
+}
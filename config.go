@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+type versionConfig struct {
+	Env map[string]string `json:"env"`
+
+	// Branches and Tags limit the variant to refs matching any of the
+	// given patterns. A variant that has neither is built for all refs,
+	// but one that has only Branches is never built for tags, and one
+	// that has only Tags is never built for branches.
+	Branches []string `json:"branches"`
+	Tags     []string `json:"tags"`
+}
+
+// variant is a named build variant from butler.json.
+type variant struct {
+	name string
+	versionConfig
+}
+
+// appliesTo returns true if the variant should be built for the given ref.
+func (v variant) appliesTo(r ref) bool {
+	if v.Branches == nil && v.Tags == nil {
+		return true
+	}
+	patterns := v.Branches
+	if r.isTag {
+		patterns = v.Tags
+	}
+	for _, p := range patterns {
+		ok, err := path.Match(p, r.name)
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// variants is a list of variants in the order they are listed in butler.json.
+type variants []variant
+
+// UnmarshalJSON parses a JSON object keeping the order of its keys.
+// Null is taken as an empty list.
+func (vs *variants) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		*vs = variants{}
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("versions must be an object")
+	}
+	list := make(variants, 0)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		v := variant{name: t.(string)}
+		err = dec.Decode(&v.versionConfig)
+		if err != nil {
+			return fmt.Errorf("version %s: %v", v.name, err)
+		}
+		list = append(list, v)
+	}
+	*vs = list
+	return nil
+}
+
+// forRef returns the variants that should be built for the given ref.
+func (vs variants) forRef(r ref) variants {
+	list := make(variants, 0)
+	for _, v := range vs {
+		if v.appliesTo(r) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+type sourceConfig struct {
+	Versions variants `json:"versions"`
+
+	// KeepGoing makes the remaining builds run after one of them fails.
+	KeepGoing bool `json:"keepGoing"`
+}
+
+func config(sourceDir string) (*sourceConfig, error) {
+	cfg := &sourceConfig{
+		Versions: variants{
+			{
+				name: "dev",
+				versionConfig: versionConfig{
+					Env: map[string]string{
+						"BUTLER_ENV": "dev",
+					},
+				},
+			},
+		},
+	}
+
+	// Read butler.json. If no such file, return the default config.
+	data, err := ioutil.ReadFile(sourceDir + "/butler.json")
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse butler.json: %v", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigVariantOrder(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"src/butler.json": `{"versions": {
+			"staging": {"env": {"API": "staging"}},
+			"dev": null,
+			"production": {"tags": ["*"]},
+			"beta": {}
+		}}`,
+	})
+	for i := 0; i < 10; i++ {
+		cfg, err := config("src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(cfg.Versions))
+		for i, v := range cfg.Versions {
+			names[i] = v.name
+		}
+		want := []string{"staging", "dev", "production", "beta"}
+		if !reflect.DeepEqual(names, want) {
+			t.Fatalf("variants %q, want %q", names, want)
+		}
+		if cfg.Versions[0].Env["API"] != "staging" {
+			t.Errorf("staging env: %v", cfg.Versions[0].Env)
+		}
+	}
+}
+
+func TestConfigVariants(t *testing.T) {
+	tests := []struct {
+		json string
+		want []string
+		err  bool
+	}{
+		{`{}`, []string{"dev"}, false},
+		{`{"versions": null}`, []string{}, false},
+		{`{"versions": {}}`, []string{}, false},
+		{`{"versions": {"a": null}}`, []string{"a"}, false},
+		{`{"versions": []}`, nil, true},
+		{`{"versions": {"a": {"env": 1}}}`, nil, true},
+	}
+	for _, tt := range tests {
+		inTempDir(t)
+		writeFiles(t, map[string]string{"src/butler.json": tt.json})
+		cfg, err := config("src")
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		names := make([]string, len(cfg.Versions))
+		for i, v := range cfg.Versions {
+			names[i] = v.name
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: variants %q, want %q", tt.json, names, tt.want)
+		}
+	}
+}
+
+func TestVariantAppliesTo(t *testing.T) {
+	all := versionConfig{}
+	branches := versionConfig{Branches: []string{"master", "release/*"}}
+	tags := versionConfig{Tags: []string{"*.*.*"}}
+	both := versionConfig{Branches: []string{"dev*"}, Tags: []string{"1.*"}}
+	none := versionConfig{Branches: []string{}, Tags: []string{}}
+	master := ref{name: "master"}
+	release := ref{name: "release/1.0"}
+	develop := ref{name: "develop"}
+	nested := ref{name: "release/1.0/fix"}
+	tag := ref{name: "1.2.0", isTag: true}
+	other := ref{name: "nightly", isTag: true}
+	tests := []struct {
+		cfg  versionConfig
+		ref  ref
+		want bool
+	}{
+		{all, master, true},
+		{all, tag, true},
+		{branches, master, true},
+		{branches, release, true},
+		{branches, develop, false},
+		// "*" doesn't match "/".
+		{branches, nested, false},
+		// Only branches are listed, so no tags.
+		{branches, tag, false},
+		{branches, ref{name: "master", isTag: true}, false},
+		{tags, tag, true},
+		{tags, other, false},
+		// Only tags are listed, so no branches.
+		{tags, master, false},
+		{tags, ref{name: "1.2.0"}, false},
+		{both, develop, true},
+		{both, master, false},
+		{both, tag, true},
+		{both, other, false},
+		{none, master, false},
+		{none, tag, false},
+	}
+	for _, tt := range tests {
+		v := variant{name: "v", versionConfig: tt.cfg}
+		if got := v.appliesTo(tt.ref); got != tt.want {
+			t.Errorf("branches %q, tags %q, %s: got %v", tt.cfg.Branches, tt.cfg.Tags, tt.ref, got)
+		}
+	}
+
+	vs := variants{
+		{name: "dev", versionConfig: all},
+		{name: "staging", versionConfig: tags},
+		{name: "qa", versionConfig: branches},
+	}
+	for _, tt := range []struct {
+		ref  ref
+		want []string
+	}{
+		{master, []string{"dev", "qa"}},
+		{tag, []string{"dev", "staging"}},
+		{develop, []string{"dev"}},
+	} {
+		names := make([]string, 0)
+		for _, v := range vs.forRef(tt.ref) {
+			names = append(names, v.name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: variants %q, want %q", tt.ref, names, tt.want)
+		}
+	}
+}
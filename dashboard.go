@@ -0,0 +1,236 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// historyEntry is a build in a project's history.
+type historyEntry struct {
+	Project  string
+	Number   int
+	Branch   string
+	Version  string
+	Status   string
+	Started  time.Time
+	Duration time.Duration
+	Commit   string
+	Author   string
+	Message  string
+}
+
+// Statuses of numbered builds that have no description of their own.
+const (
+	statusRunning     = "running"
+	statusInterrupted = "interrupted"
+	statusReplaced    = "replaced"
+)
+
+// describe returns the history entry for the numbered build. Only the
+// build's own description is read.
+func describe(project string, r storage.BuildRef, active map[int]runningBuild) (historyEntry, error) {
+	e := historyEntry{
+		Project: project,
+		Number:  r.Number,
+		Branch:  r.Branch,
+		Version: r.Version,
+	}
+	if b, ok := active[r.Number]; ok {
+		e.Status = statusRunning
+		e.Started = b.Started
+		return e, nil
+	}
+	info, err := storage.Info(project, r.Branch, r.Version)
+	if err != nil && !os.IsNotExist(err) {
+		return e, err
+	}
+	switch {
+	case info != nil && info.Number == r.Number:
+		e.Status = info.Status
+		e.Started = info.Started
+		e.Duration = info.Finished.Sub(info.Started)
+		e.Commit = info.Commit
+		e.Author = info.Author
+		e.Message = info.Message
+	case info != nil && info.Number > r.Number:
+		e.Status = statusReplaced
+	default:
+		// The build didn't finish and wasn't recovered.
+		e.Status = statusInterrupted
+	}
+	return e, nil
+}
+
+// activeBuilds returns the project's running builds by number.
+func activeBuilds(project string) map[int]runningBuild {
+	active := make(map[int]runningBuild)
+	for _, b := range running.list() {
+		if b.Project == project {
+			active[b.Number] = b
+		}
+	}
+	return active
+}
+
+// history returns at most n of the project's numbered builds, newest first,
+// starting with the one before the given number, or with the newest one
+// if the number is zero. It also returns the number to pass to get the
+// next older builds, or zero if there are no more.
+func history(project string, before, n int) ([]historyEntry, int, error) {
+	refs, err := storage.BuildNumbers(project)
+	if err != nil {
+		return nil, 0, err
+	}
+	active := activeBuilds(project)
+	list := make([]historyEntry, 0, n)
+	for i := len(refs) - 1; i >= 0; i-- {
+		if before > 0 && refs[i].Number >= before {
+			continue
+		}
+		if len(list) == n {
+			return list, list[n-1].Number, nil
+		}
+		e, err := describe(project, refs[i], active)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, e)
+	}
+	return list, 0, nil
+}
+
+type projectSummary struct {
+	Name     string
+	Branches []historyEntry
+	Error    string
+}
+
+type dashboardPage struct {
+	Projects []projectSummary
+	Running  []runningBuild
+	Queued   int
+	Failures []historyEntry
+}
+
+// recentFailures is how many failed builds the dashboard shows.
+const recentFailures = 10
+
+func rootPage(w http.ResponseWriter) {
+	names, err := storage.ProjectNames()
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+
+	page := dashboardPage{
+		Projects: make([]projectSummary, 0, len(names)),
+		Running:  running.list(),
+		Queued:   queue.len(),
+		Failures: make([]historyEntry, 0),
+	}
+	for _, name := range names {
+		summary, failures, err := summarize(name)
+		if err != nil {
+			slog.Error("failed to read the project's builds", "project", name, "err", err)
+			summary.Error = err.Error()
+		}
+		page.Projects = append(page.Projects, summary)
+		page.Failures = append(page.Failures, failures...)
+	}
+	sort.Slice(page.Failures, func(i, j int) bool {
+		return page.Failures[i].Started.After(page.Failures[j].Started)
+	})
+	if len(page.Failures) > recentFailures {
+		page.Failures = page.Failures[:recentFailures]
+	}
+	render(w, "dashboard", page)
+}
+
+// summarize returns the latest build of every branch of the project
+// and the project's failures among its last builds. Descriptions are
+// read only for those builds, so that the dashboard doesn't read the
+// whole history of every project.
+func summarize(project string) (projectSummary, []historyEntry, error) {
+	summary := projectSummary{
+		Name:     project,
+		Branches: make([]historyEntry, 0),
+	}
+	refs, err := storage.BuildNumbers(project)
+	if err != nil {
+		return summary, nil, err
+	}
+	active := activeBuilds(project)
+	failures := make([]historyEntry, 0)
+	seen := make(map[string]bool)
+	for i := len(refs) - 1; i >= 0; i-- {
+		r := refs[i]
+		recent := i >= len(refs)-recentFailures
+		if seen[r.Branch] && !recent {
+			continue
+		}
+		e, err := describe(project, r, active)
+		if err != nil {
+			return summary, nil, err
+		}
+		if !seen[r.Branch] {
+			seen[r.Branch] = true
+			summary.Branches = append(summary.Branches, e)
+		}
+		if recent && e.Status == storage.StatusFailed {
+			failures = append(failures, e)
+		}
+	}
+	sort.Slice(summary.Branches, func(i, j int) bool {
+		return summary.Branches[i].Branch < summary.Branches[j].Branch
+	})
+	return summary, failures, nil
+}
+
+type projectPage struct {
+	Name     string
+	Branches []string
+	Running  []runningBuild
+	History  []historyEntry
+
+	// Older is the number to show the older builds from,
+	// or zero if there are none.
+	Older int
+}
+
+// historyLength is how many builds the project page shows at once.
+const historyLength = 50
+
+func projectIndex(w http.ResponseWriter, projectName string, before int) {
+	branches, err := storage.Branches(projectName)
+	if os.IsNotExist(err) {
+		statusPage(w, 404, "Not found")
+		return
+	}
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+	h, older, err := history(projectName, before, historyLength)
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+	page := projectPage{
+		Name:     projectName,
+		Branches: branches,
+		Running:  make([]runningBuild, 0),
+		History:  h,
+		Older:    older,
+	}
+	for _, b := range running.list() {
+		if b.Project == projectName {
+			page.Running = append(page.Running, b)
+		}
+	}
+	render(w, "project", page)
+}
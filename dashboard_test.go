@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// countingStorage counts reads of build descriptions.
+type countingStorage struct {
+	storage.Storage
+	reads int32
+}
+
+func (s *countingStorage) Build(project, branch, version, file string) (storage.File, error) {
+	if file == "build.json" {
+		atomic.AddInt32(&s.reads, 1)
+	}
+	return s.Storage.Build(project, branch, version, file)
+}
+
+func infoJSON(number int, status string) string {
+	return fmt.Sprintf(`{"number": %d, "status": %q, "started": "2024-01-02T03:04:05Z", "finished": "2024-01-02T03:05:05Z"}`, number, status)
+}
+
+func getPage(t *testing.T, path string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != 200 {
+		t.Fatalf("GET %s: status %d: %s", path, w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestHistoryStatuses(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/app/buildnumbers": "1\tmaster\t1.0.0\n" +
+			"2\tmaster\t1.0.0\n" +
+			"3\tmaster\t1.0.1\n" +
+			"4\tdevelop\t1.0.2\n" +
+			"5\tdevelop\t1.0.3\n",
+		"projects/app/builds/master/1.0.0/build.json": infoJSON(2, "ok"),
+		"projects/app/builds/master/1.0.1/build.json": infoJSON(3, "failed"),
+	})
+	b := runningBuild{Project: "app", Ref: ref{name: "develop"}, Version: "1.0.3", Number: 5, Started: time.Now()}
+	running.start(b)
+	defer running.finish(b)
+
+	h, older, err := history("app", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{statusRunning, statusInterrupted, storage.StatusFailed, storage.StatusOK, statusReplaced}
+	if len(h) != len(want) || older != 0 {
+		t.Fatalf("got %d entries and %d, want %d and 0", len(h), older, len(want))
+	}
+	for i, e := range h {
+		if e.Number != 5-i || e.Status != want[i] {
+			t.Errorf("entry %d is #%d %s, want #%d %s", i, e.Number, e.Status, 5-i, want[i])
+		}
+	}
+
+	page := getPage(t, "/app")
+	for _, s := range []string{"running for", "interrupted before it finished", "replaced by a later build"} {
+		if !strings.Contains(page, s) {
+			t.Errorf("the project page doesn't say %q", s)
+		}
+	}
+	dashboard := getPage(t, "/")
+	if !strings.Contains(dashboard, `class="running">running`) {
+		t.Error("the dashboard doesn't show the running build")
+	}
+}
+
+func TestHistoryPages(t *testing.T) {
+	inTempDir(t)
+	index := ""
+	for i := 1; i <= 5; i++ {
+		index += fmt.Sprintf("%d\tmaster\t1.0.%d\n", i, i)
+	}
+	writeFiles(t, map[string]string{"projects/app/buildnumbers": index})
+
+	h, older, err := history("app", 0, 2)
+	if err != nil || len(h) != 2 || h[0].Number != 5 || older != 4 {
+		t.Fatalf("first page: %+v, %d, %v", h, older, err)
+	}
+	h, older, err = history("app", older, 2)
+	if err != nil || len(h) != 2 || h[0].Number != 3 || older != 2 {
+		t.Fatalf("second page: %+v, %d, %v", h, older, err)
+	}
+	h, older, err = history("app", older, 2)
+	if err != nil || len(h) != 1 || h[0].Number != 1 || older != 0 {
+		t.Fatalf("last page: %+v, %d, %v", h, older, err)
+	}
+}
+
+// The dashboard reads only the descriptions of the latest build of every
+// branch and of the last few builds, and not the whole history.
+func TestDashboardReads(t *testing.T) {
+	inTempDir(t)
+	files := map[string]string{}
+	index := ""
+	for i := 1; i <= 50; i++ {
+		v := fmt.Sprintf("1.0.%d", i)
+		index += fmt.Sprintf("%d\tmaster\t%s\n", i, v)
+		files["projects/app/builds/master/"+v+"/build.json"] = infoJSON(i, "ok")
+	}
+	index += "51\tdevelop\t2.0.0\n"
+	files["projects/app/builds/develop/2.0.0/build.json"] = infoJSON(51, "failed")
+	files["projects/app/buildnumbers"] = index
+	writeFiles(t, files)
+
+	s := &countingStorage{Storage: storage.Local()}
+	storage.SetBackend(s)
+	defer storage.SetBackend(storage.Local())
+
+	page := getPage(t, "/")
+	if s.reads > recentFailures {
+		t.Errorf("%d descriptions read, want at most %d", s.reads, recentFailures)
+	}
+	for _, want := range []string{"#50</a> 1.0.50", "#51</a> 2.0.0"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the dashboard doesn't show %q", want)
+		}
+	}
+}
+
+// A project whose builds can't be read doesn't break the dashboard.
+func TestDashboardProjectError(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/good/buildnumbers":                   "1\tmaster\t1.0.0\n",
+		"projects/good/builds/master/1.0.0/build.json": infoJSON(1, "ok"),
+		"projects/bad/buildnumbers":                    "1\tmaster\t1.0.0\n",
+		"projects/bad/builds/master/1.0.0/build.json":  "{",
+		"projects/bad/project.json":                    "{",
+	})
+	page := getPage(t, "/")
+	if !strings.Contains(page, `class="failed" colspan="4">unexpected end of JSON input`) {
+		t.Error("the dashboard doesn't show the bad project's error")
+	}
+	if !strings.Contains(page, "#1</a> 1.0.0") {
+		t.Error("the dashboard doesn't show the good project")
+	}
+}
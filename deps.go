@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// upstreamBuild is a finished build of an upstream project.
+type upstreamBuild struct {
+	project string
+	branch  string
+	version string
+}
+
+// dependencies returns all links between projects, whether declared
+// by the downstream projects in dependsOn or by the upstream ones in triggers.
+// Links are given from the upstream side, with Project being the downstream project.
+func dependencies(projects []storage.Project) map[string][]storage.Dependency {
+	links := make(map[string][]storage.Dependency)
+	add := func(upstream string, d storage.Dependency) {
+		for _, l := range links[upstream] {
+			if l == d {
+				return
+			}
+		}
+		links[upstream] = append(links[upstream], d)
+	}
+	for _, p := range projects {
+		for _, d := range p.DependsOn {
+			add(d.Project, storage.Dependency{Project: p.Name, Branch: d.Branch, Target: d.Target})
+		}
+		for _, d := range p.Triggers {
+			add(p.Name, d)
+		}
+	}
+	return links
+}
+
+// queueDownstream queues builds of projects that depend on the given
+// successful build. The chain lists projects whose builds led to this one,
+// so that circular dependencies don't cause endless rebuilds.
+func queueDownstream(project string, r ref, version string, chain []string) {
+	if r.isTag {
+		return
+	}
+	projects, err := storage.Projects()
+	if err != nil {
+		slog.Error("failed to get downstream projects", "project", project, "err", err)
+		return
+	}
+	chain = append(append([]string{}, chain...), project)
+	for _, d := range dependencies(projects)[project] {
+		if d.Branch != r.name {
+			continue
+		}
+		if contains(chain, d.Project) {
+			slog.Warn("not triggering a circular dependency", "project", project, "downstream", d.Project, "chain", strings.Join(chain, " -> "))
+			continue
+		}
+		slog.Info("triggering a downstream build", "project", project, "downstream", d.Project, "target", d.Target)
+		queue.push(buildRequest{
+			project: d.Project,
+			ref:     ref{name: d.Target},
+			upstream: &upstreamBuild{
+				project: project,
+				branch:  r.name,
+				version: version,
+			},
+			chain: chain,
+		})
+	}
+}
+
+// upstreamEnv returns variables pointing to the artifacts of the project's
+// upstream builds. For every dependency, BUTLER_UPSTREAM_<PROJECT>_DIR is
+// the directory with the latest successful build of the upstream branch.
+// If the build was triggered by an upstream build, BUTLER_UPSTREAM_DIR and
+// other BUTLER_UPSTREAM_* variables describe that build. Builds that are
+// not kept locally are downloaded to subdirectories of tmp.
+func upstreamEnv(project storage.Project, trigger *upstreamBuild, tmp string) []string {
+	vars := make([]string, 0)
+	for _, d := range project.DependsOn {
+		b, err := latestSuccessful(d.Project, d.Branch)
+		if err != nil {
+			slog.Error("failed to find an upstream build", "project", project.Name, "upstream", d.Project, "branch", d.Branch, "err", err)
+			continue
+		}
+		if b == nil {
+			continue
+		}
+		dir, err := storage.BuildDir(d.Project, b.Branch, b.Version, tmp+"/depends/"+d.Project)
+		if err != nil {
+			slog.Error("failed to get an upstream build", "project", project.Name, "err", err)
+			continue
+		}
+		vars = append(vars, "BUTLER_UPSTREAM_"+envName(d.Project)+"_DIR="+dir)
+	}
+	if trigger != nil {
+		dir, err := storage.BuildDir(trigger.project, trigger.branch, trigger.version, tmp+"/trigger")
+		if err != nil {
+			slog.Error("failed to get an upstream build", "project", project.Name, "err", err)
+			return vars
+		}
+		vars = append(vars,
+			"BUTLER_UPSTREAM_PROJECT="+trigger.project,
+			"BUTLER_UPSTREAM_BRANCH="+trigger.branch,
+			"BUTLER_UPSTREAM_VERSION="+trigger.version,
+			"BUTLER_UPSTREAM_DIR="+dir,
+		)
+	}
+	return vars
+}
+
+// latestSuccessful returns the newest successful build of the given branch.
+// If there is none, nil is returned.
+func latestSuccessful(project, branch string) (*storage.BuildRef, error) {
+	refs, err := storage.BuildNumbers(project)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(refs) - 1; i >= 0; i-- {
+		r := refs[i]
+		if r.Branch != branch {
+			continue
+		}
+		info, err := storage.Info(project, r.Branch, r.Version)
+		if err != nil || info.Number != r.Number {
+			continue
+		}
+		if info.Status == storage.StatusOK {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+// envName converts a name to a form usable in an environment variable's name.
+func envName(name string) string {
+	b := strings.Builder{}
+	for _, ch := range strings.ToUpper(name) {
+		if (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') {
+			b.WriteRune(ch)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
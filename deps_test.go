@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// Links declared on either side end up on the upstream side, once.
+func TestDependencies(t *testing.T) {
+	projects := []storage.Project{
+		{Name: "lib", Triggers: []storage.Dependency{
+			{Project: "app", Branch: "master", Target: "master"},
+			{Project: "docs", Branch: "master", Target: "gh-pages"},
+		}},
+		{Name: "app", DependsOn: []storage.Dependency{
+			// The same link as in lib's triggers.
+			{Project: "lib", Branch: "master", Target: "master"},
+			{Project: "lib", Branch: "develop", Target: "develop"},
+			{Project: "sdk", Branch: "master", Target: "master"},
+		}},
+		{Name: "docs"},
+	}
+	got := dependencies(projects)
+	want := map[string][]storage.Dependency{
+		"lib": {
+			{Project: "app", Branch: "develop", Target: "develop"},
+			{Project: "app", Branch: "master", Target: "master"},
+			{Project: "docs", Branch: "master", Target: "gh-pages"},
+		},
+		"sdk": {
+			{Project: "app", Branch: "master", Target: "master"},
+		},
+	}
+	for _, links := range got {
+		sort.Slice(links, func(i, j int) bool {
+			if links[i].Project != links[j].Project {
+				return links[i].Project < links[j].Project
+			}
+			return links[i].Branch < links[j].Branch
+		})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// Downstream builds are queued for the matching branch only, and never
+// for projects that are already in the chain.
+func TestQueueDownstream(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/a/project.json": `{"triggers": [{"project": "b"}]}`,
+		"projects/b/project.json": `{"triggers": [{"project": "a"}, {"project": "c", "target": "next"}]}`,
+		"projects/c/project.json": `{"dependsOn": [{"project": "b", "branch": "develop"}]}`,
+	})
+	defer queue.take("a")
+	defer queue.take("b")
+	defer queue.take("c")
+
+	queueDownstream("a", ref{name: "master"}, "1.0.0", nil)
+	got := queue.take("b")
+	if len(got) != 1 {
+		t.Fatalf("queued %+v for b", got)
+	}
+	want := buildRequest{
+		project:  "b",
+		ref:      ref{name: "master"},
+		upstream: &upstreamBuild{project: "a", branch: "master", version: "1.0.0"},
+		chain:    []string{"a"},
+	}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got %+v, want %+v", got[0], want)
+	}
+
+	// b's build triggers c but not a, which led to it.
+	queueDownstream("b", ref{name: "master"}, "2.0.0", got[0].chain)
+	if a := queue.take("a"); len(a) != 0 {
+		t.Errorf("a is queued again: %+v", a)
+	}
+	c := queue.take("c")
+	if len(c) != 1 || c[0].ref.name != "next" || !reflect.DeepEqual(c[0].chain, []string{"a", "b"}) {
+		t.Errorf("queued %+v for c", c)
+	}
+
+	queueDownstream("b", ref{name: "develop"}, "2.1.0", nil)
+	c = queue.take("c")
+	if len(c) != 1 || c[0].ref.name != "master" {
+		t.Errorf("queued %+v for c on develop", c)
+	}
+
+	// Tags and other branches trigger nothing.
+	queueDownstream("a", ref{name: "1.0.0", isTag: true}, "1.0.0", nil)
+	queueDownstream("a", ref{name: "feature"}, "1.0.0", nil)
+	if n := queue.len(); n != 0 {
+		t.Errorf("%d requests queued", n)
+	}
+}
+
+func TestUpstreamEnv(t *testing.T) {
+	dir := inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/lib/buildnumbers": "1\tmaster\t1.0.0\n2\tmaster\t1.1.0\n3\tdevelop\t2.0.0\n4\tmaster\t1.2.0\n5\tmaster\t1.0.0\n",
+		// 1.0.0 was rebuilt as #5, which failed.
+		"projects/lib/builds/master/1.0.0/build.json":  infoJSON(5, "failed"),
+		"projects/lib/builds/master/1.1.0/build.json":  infoJSON(2, "ok"),
+		"projects/lib/builds/develop/2.0.0/build.json": infoJSON(3, "ok"),
+		"projects/lib/builds/master/1.2.0/build.json":  infoJSON(4, "failed"),
+		"projects/sdk/buildnumbers":                    "1\tmaster\t0.1.0\n",
+		"projects/sdk/builds/master/0.1.0/build.json":  infoJSON(1, "failed"),
+	})
+	project := storage.Project{
+		Name: "app",
+		DependsOn: []storage.Dependency{
+			{Project: "lib", Branch: "master"},
+			{Project: "sdk", Branch: "master"},
+			{Project: "none", Branch: "master"},
+		},
+	}
+	got := upstreamEnv(project, nil, "tmp/upstream")
+	libDir := filepath.Join(dir, "projects/lib/builds/master/1.1.0")
+	want := []string{"BUTLER_UPSTREAM_LIB_DIR=" + libDir}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	trigger := &upstreamBuild{project: "lib", branch: "develop", version: "2.0.0"}
+	got = upstreamEnv(storage.Project{Name: "app"}, trigger, "tmp/upstream")
+	want = []string{
+		"BUTLER_UPSTREAM_PROJECT=lib",
+		"BUTLER_UPSTREAM_BRANCH=develop",
+		"BUTLER_UPSTREAM_VERSION=2.0.0",
+		"BUTLER_UPSTREAM_DIR=" + filepath.Join(dir, "projects/lib/builds/develop/2.0.0"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for name, want := range map[string]string{
+		"lib":        "LIB",
+		"my-lib.v2":  "MY_LIB_V2",
+		"Core_Utils": "CORE_UTILS",
+	} {
+		if got := envName(name); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// diskFree returns the number of bytes available to butler
+// on the disk with the given directory.
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
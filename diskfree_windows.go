@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
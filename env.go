@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// Sources of build environment variables, from lowest to highest precedence.
+const (
+	sourceHost     = "host"
+	sourceServer   = "server"
+	sourceProject  = "project"
+	sourceSecrets  = "secrets"
+	sourceUpstream = "upstream"
+	sourceVariant  = "variant"
+	sourceButler   = "butler"
+	sourceOverride = "override"
+)
+
+// envLayer is a set of environment variables from one source.
+type envLayer struct {
+	source string
+	vars   []string
+}
+
+// environment is a build environment made of layers. A variable in a later
+// layer overrides the same variable in the earlier ones.
+type environment struct {
+	layers []envLayer
+}
+
+// add adds a layer of variables given as "name=value" strings.
+func (e *environment) add(source string, vars []string) {
+	e.layers = append(e.layers, envLayer{source: source, vars: vars})
+}
+
+// with returns a copy of the environment with another layer on top.
+func (e *environment) with(source string, vars []string) *environment {
+	c := &environment{
+		layers: make([]envLayer, len(e.layers), len(e.layers)+1),
+	}
+	copy(c.layers, e.layers)
+	c.add(source, vars)
+	return c
+}
+
+// effective returns the resulting variables in the order they first
+// appear, each with the layer it finally came from.
+func (e *environment) effective() ([]string, map[string]envLayer, map[string]string) {
+	names := make([]string, 0)
+	layers := make(map[string]envLayer)
+	values := make(map[string]string)
+	for _, layer := range e.layers {
+		for _, v := range layer.vars {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				continue
+			}
+			if _, ok := values[parts[0]]; !ok {
+				names = append(names, parts[0])
+			}
+			values[parts[0]] = parts[1]
+			layers[parts[0]] = layer
+		}
+	}
+	return names, layers, values
+}
+
+// list returns the effective environment as "name=value" strings.
+func (e *environment) list() []string {
+	names, _, values := e.effective()
+	list := make([]string, len(names))
+	for i, name := range names {
+		list[i] = name + "=" + values[name]
+	}
+	return list
+}
+
+// record returns the names of the effective environment's variables
+// with their sources for saving with the build. Values are not saved,
+// since any of them might be a credential.
+func (e *environment) record() []storage.EnvVar {
+	names, layers, _ := e.effective()
+	sort.Strings(names)
+	vars := make([]storage.EnvVar, len(names))
+	for i, name := range names {
+		vars[i] = storage.EnvVar{
+			Name:   name,
+			Source: layers[name].source,
+		}
+	}
+	return vars
+}
+
+func toEnvList(vars map[string]string) []string {
+	list := make([]string, 0)
+	for k, v := range vars {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// buildSecrets returns the project's secrets that builds get as variables.
+// The repository token is only for git and is left out.
+func buildSecrets(project storage.Project, secrets map[string]string) map[string]string {
+	if project.Remote == nil || project.Remote.Auth.TokenSecret == "" {
+		return secrets
+	}
+	r := make(map[string]string, len(secrets))
+	for k, v := range secrets {
+		if k != project.Remote.Auth.TokenSecret {
+			r[k] = v
+		}
+	}
+	return r
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+func TestEnvironmentLayers(t *testing.T) {
+	env := &environment{}
+	env.add(sourceHost, []string{"PATH=/bin", "A=host"})
+	env.add(sourceSecrets, []string{"TOKEN=secret"})
+	env.add(sourceProject, []string{"A=project", "B=b=c", "=bad", "bad"})
+	cell := env.with(sourceOverride, []string{"A=override"})
+
+	want := []string{"PATH=/bin", "A=project", "TOKEN=secret", "B=b=c"}
+	if got := env.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("list = %q, want %q", got, want)
+	}
+	if got := cell.list()[1]; got != "A=override" {
+		t.Errorf("the override layer gave %q", got)
+	}
+	if len(env.layers) != 3 {
+		t.Error("with changed the original environment")
+	}
+
+	wantRecord := []storage.EnvVar{
+		{Name: "A", Source: sourceOverride},
+		{Name: "B", Source: sourceProject},
+		{Name: "PATH", Source: sourceHost},
+		{Name: "TOKEN", Source: sourceSecrets},
+	}
+	if got := cell.record(); !reflect.DeepEqual(got, wantRecord) {
+		t.Errorf("record = %+v, want %+v", got, wantRecord)
+	}
+}
+
+func TestHostEnvFilter(t *testing.T) {
+	vars := []string{"PATH=/bin", "HOME=/root", "AWS_SECRET_ACCESS_KEY=x", "BUTLER_MASTER_KEY=k", "ANDROID_HOME=/sdk"}
+	tests := []struct {
+		filter hostEnvFilter
+		want   []string
+	}{
+		{hostEnvFilter{}, []string{"PATH=/bin", "HOME=/root", "AWS_SECRET_ACCESS_KEY=x", "ANDROID_HOME=/sdk"}},
+		{hostEnvFilter{Deny: []string{"AWS_*"}}, []string{"PATH=/bin", "HOME=/root", "ANDROID_HOME=/sdk"}},
+		{hostEnvFilter{Allow: []string{"PATH", "ANDROID_*"}}, []string{"PATH=/bin", "ANDROID_HOME=/sdk"}},
+		{hostEnvFilter{Allow: []string{"*"}, Deny: []string{"AWS_*"}}, []string{"PATH=/bin", "HOME=/root", "ANDROID_HOME=/sdk"}},
+	}
+	for _, tt := range tests {
+		got := tt.filter.filter(vars)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+// The repository token is for git only and never reaches builds.
+func TestBuildSecretsWithoutToken(t *testing.T) {
+	secrets := map[string]string{"REPO_TOKEN": "t0ken", "KEY_PASSWORD": "pw"}
+	project := storage.Project{Remote: &storage.Remote{Auth: storage.Auth{TokenSecret: "REPO_TOKEN"}}}
+	got := buildSecrets(project, secrets)
+	if len(got) != 1 || got["KEY_PASSWORD"] != "pw" {
+		t.Errorf("got %v", got)
+	}
+	if len(secrets) != 2 {
+		t.Error("the project's secrets were changed")
+	}
+	if got := buildSecrets(storage.Project{}, secrets); len(got) != 2 {
+		t.Errorf("got %v without a remote", got)
+	}
+}
@@ -1,47 +1,213 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/gaswelder/butler/storage"
 )
 
-type git struct {
+// git works with a project's clone. A project's builds run one at a time
+// in the clone's only working tree, so there are no operations for linked
+// worktrees ("git worktree"), which go-git doesn't have either.
+type git interface {
+	// dir returns the path to the clone.
+	dir() string
+
+	// clone clones the repository into the directory.
+	clone(r *storage.Remote) error
+
+	// check returns nil if the directory has a usable clone, and
+	// a *noCloneError if it provably has no clone or the clone is broken.
+	// Other errors, like a locked index, don't say anything about the clone.
+	check() error
+
+	// setRemote points the origin remote to the given URL.
+	setRemote(url string) error
+
+	// fetch fetches the given branches and tags of the remote and removes
+	// the ones deleted on the remote. The remote's refs, as returned by
+	// remoteRefs, tell which branches and tags are gone.
+	fetch(refs map[string]string, names []string) error
+
+	// remoteRefs asks the remote for its branches and tags and returns
+	// their hashes by full ref names, like "refs/heads/master".
+	remoteRefs() (map[string]string, error)
+
+	// branches returns the names of the remote branches to build.
+	branches() ([]string, error)
+
+	// tags returns the version tags, lowest version first.
+	tags() ([]string, error)
+
+	// describe returns the name of the given ref relative to the nearest
+	// tag, like "1.2.0-3-gabcdef0".
+	describe(ref string) (string, error)
+
+	// checkout checks out the given branch or tag.
+	checkout(name string) error
+
+	// pull updates the checked out branch from the remote.
+	pull() error
+
+	// discard drops changes made in the working tree.
+	discard() error
+
+	// commit returns the hash of the checked out commit.
+	commit() (string, error)
+
+	// commitInfo returns the author and the subject of the checked out commit.
+	commitInfo() (string, string, error)
+}
+
+// cliGit runs the git program.
+type cliGit struct {
 	sourceDir string
+
+	// log receives the output of git commands. If it's nil,
+	// the output is discarded.
+	log io.Writer
+
+	// env has variables added to the environment of git commands.
+	env []string
+
+	// defaultBranch is built in addition to the usual branches.
+	defaultBranch string
+
+	// shallow is true if the clone has only part of the history.
+	shallow bool
 }
 
-func run(cwd string, prog string, args ...string) error {
-	c := exec.Command(prog, args...)
-	c.Dir = cwd
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	return c.Run()
+func (g cliGit) dir() string {
+	return g.sourceDir
+}
+
+// run runs a git command with its output going to the log.
+func (g cliGit) run(args ...string) error {
+	_, err := g.exec(args, false)
+	return err
 }
 
-func runOut(cwd string, prog string, args ...string) ([]string, error) {
-	cmd := exec.Command(prog, args...)
-	cmd.Dir = cwd
-	cmd.Stderr = os.Stderr
-	out, err := cmd.Output()
+// runOut runs a git command and returns the lines it printed.
+// Only errors go to the log.
+func (g cliGit) runOut(args ...string) ([]string, error) {
+	out, err := g.exec(args, true)
 	if err != nil {
 		return nil, err
 	}
-	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+	return strings.Split(strings.TrimSpace(out), "\n"), nil
+}
+
+func (g cliGit) exec(args []string, capture bool) (string, error) {
+	return g.execIn(g.sourceDir, args, capture)
+}
+
+func (g cliGit) execIn(dir string, args []string, capture bool) (string, error) {
+	logger := g.log
+	if logger == nil {
+		logger = ioutil.Discard
+	}
+	fmt.Fprintf(logger, "$ git %s\n", strings.Join(args, " "))
+
+	var stdout, stderr bytes.Buffer
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	if len(g.env) > 0 {
+		c.Env = append(os.Environ(), g.env...)
+	}
+	c.Stdout = logger
+	if capture {
+		c.Stdout = &stdout
+	}
+	// Keep the errors to explain the failure.
+	c.Stderr = io.MultiWriter(logger, &stderr)
+	err := c.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.LastIndex(msg, "\n"); i >= 0 {
+			msg = msg[i+1:]
+		}
+		if msg != "" {
+			return "", fmt.Errorf("git %s: %v: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return stdout.String(), nil
 }
 
-func (g git) pull() error {
-	return run(g.sourceDir, "git", "pull")
+func (g cliGit) pull() error {
+	return g.run("pull")
 }
 
-func (g git) fetch() error {
-	err := run(g.sourceDir, "git", "fetch", "-p")
+// fetchBatch is how many refs one git command fetches at most,
+// so that the command line stays short.
+const fetchBatch = 100
+
+func (g cliGit) fetch(refs map[string]string, names []string) error {
+	specs := refspecs(refs, names)
+	for len(specs) > 0 {
+		n := len(specs)
+		if n > fetchBatch {
+			n = fetchBatch
+		}
+		args := append([]string{"fetch", "--no-tags", "origin"}, specs[:n]...)
+		if err := g.run(args...); err != nil {
+			return err
+		}
+		specs = specs[n:]
+	}
+	if err := g.pruneBranches(refs); err != nil {
+		return err
+	}
+	return g.pruneTags(refs)
+}
+
+// refspecs returns the refspecs that fetch the given refs that the remote
+// has: branches to the remote branches of origin and tags to the tags.
+func refspecs(refs map[string]string, names []string) []string {
+	specs := make([]string, 0)
+	for _, name := range names {
+		if _, ok := refs[name]; !ok {
+			continue
+		}
+		if strings.HasPrefix(name, "refs/heads/") {
+			specs = append(specs, "+"+name+":refs/remotes/origin/"+strings.TrimPrefix(name, "refs/heads/"))
+		} else {
+			specs = append(specs, "+"+name+":"+name)
+		}
+	}
+	return specs
+}
+
+// pruneBranches deletes the remote branches of origin that are not among
+// the given remote refs.
+func (g cliGit) pruneBranches(refs map[string]string) error {
+	local, err := g.runOut("for-each-ref", "--format=%(refname)", "refs/remotes/origin/")
 	if err != nil {
 		return err
 	}
-	err = g.pruneTags()
-	return err
+	for _, name := range local {
+		branch := strings.TrimPrefix(name, "refs/remotes/origin/")
+		if name == "" || branch == "HEAD" {
+			continue
+		}
+		if _, ok := refs["refs/heads/"+branch]; ok {
+			continue
+		}
+		if err := g.run("update-ref", "-d", name); err != nil {
+			return fmt.Errorf("failed to delete branch %s: %v", branch, err)
+		}
+	}
+	return nil
 }
 
 // Takes an output of git show-ref or git ls-remote as an array of lines
@@ -78,17 +244,15 @@ func subtractArray(a, b []string) []string {
 	return diff
 }
 
-func (g git) pruneTags() error {
-	// Get remote tags and local tags.
-	remote, err := runOut(g.sourceDir, "git", "ls-remote", "-t")
-	if err != nil {
-		return err
-	}
-	remote, err = parseTags(remote)
-	if err != nil {
-		return err
+// pruneTags deletes the tags that are not among the given remote refs.
+func (g cliGit) pruneTags(refs map[string]string) error {
+	remote := make([]string, 0)
+	for name := range refs {
+		if strings.HasPrefix(name, "refs/tags/") {
+			remote = append(remote, strings.TrimPrefix(name, "refs/tags/"))
+		}
 	}
-	local, err := runOut(g.sourceDir, "git", "show-ref", "--tags")
+	local, err := g.runOut("show-ref", "--tags")
 	if err != nil {
 		return err
 	}
@@ -100,8 +264,7 @@ func (g git) pruneTags() error {
 	// Figure out what tags were deleted on the server and delete them locally.
 	deleted := subtractArray(local, remote)
 	for _, tag := range deleted {
-		fmt.Fprintf(os.Stdout, "deleting tag %s\n", tag)
-		err := run(g.sourceDir, "git", "tag", "-d", tag)
+		err := g.run("tag", "-d", tag)
 		if err != nil {
 			return fmt.Errorf("failed to delete tag %s: %v", tag, err)
 		}
@@ -110,36 +273,65 @@ func (g git) pruneTags() error {
 	return nil
 }
 
-func (g git) discard() error {
-	err := run(g.sourceDir, "git", "clean", "-fd")
+func (g cliGit) discard() error {
+	err := g.run("clean", "-fd")
 	if err != nil {
 		return err
 	}
-	return run(g.sourceDir, "git", "checkout", ".")
+	return g.run("checkout", ".")
+}
+
+// validRefName returns true if the name can be a branch or tag name by the
+// rules of "git check-ref-format" and can't be taken for an option.
+func validRefName(name string) bool {
+	if name == "" || name == "@" || name[0] == '-' || name[0] == '/' ||
+		strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "//") ||
+		strings.Contains(name, "@{") {
+		return false
+	}
+	for _, ch := range name {
+		if ch < 0x20 || ch == 0x7f || strings.ContainsRune(" ~^:?*[\\", ch) {
+			return false
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return true
 }
 
-type branch struct {
-	name string
-	desc string
+// branchIsBuildable returns true if the branch should be built.
+// A branch named like the releases directory is never built, since
+// its builds would be mixed up with the releases.
+func branchIsBuildable(branch, defaultBranch string) bool {
+	if reservedBranch(branch) {
+		return false
+	}
+	return strings.HasPrefix(branch, "dev") || branch == "master" || branch == "butler" ||
+		(defaultBranch != "" && branch == defaultBranch)
 }
 
-func branchIsBuildable(branch string) bool {
-	return strings.HasPrefix(branch, "dev") || branch == "master" || branch == "butler"
+// reservedBranch returns true for the branch name that is taken
+// by the releases directory.
+func reservedBranch(name string) bool {
+	return name == storage.ReleasesDirectory
 }
 
-func (g git) tags() ([]string, error) {
-	lines, err := runOut(g.sourceDir, "git", "tag", "-l", "--sort", "v:refname")
+// versionTag matches tags that are release versions.
+var versionTag = regexp.MustCompile(`^\d+.\d+.\d+(-\d+)?$`)
+
+func (g cliGit) tags() ([]string, error) {
+	lines, err := g.runOut("tag", "-l", "--sort", "v:refname")
 	if err != nil {
 		return nil, err
 	}
 
 	versions := make([]string, 0)
 	for _, line := range lines {
-		isTag, err := regexp.Match(`^\d+.\d+.\d+(-\d+)?$`, []byte(line))
-		if err != nil {
-			return nil, fmt.Errorf("regexp error: %v", err)
-		}
-		if !isTag {
+		if !versionTag.MatchString(line) {
 			continue
 		}
 		versions = append(versions, line)
@@ -147,14 +339,14 @@ func (g git) tags() ([]string, error) {
 	return versions, nil
 }
 
-// branches returns a list of remote branches in this repository.
-func (g git) branches() ([]branch, error) {
-	lines, err := runOut(g.sourceDir, "git", "branch", "-r")
+// branches returns the names of remote branches to build.
+func (g cliGit) branches() ([]string, error) {
+	lines, err := g.runOut("branch", "-r")
 	if err != nil {
 		return nil, err
 	}
 
-	branches := make([]branch, 0)
+	branches := make([]string, 0)
 
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
@@ -166,27 +358,49 @@ func (g git) branches() ([]branch, error) {
 		parts := strings.SplitN(line, "/", 2)
 
 		// Skip branches that we are not going to build.
-		if !branchIsBuildable(parts[1]) {
+		if !branchIsBuildable(parts[1], g.defaultBranch) {
 			continue
 		}
-		desc, err := g.describe(line)
-		if err != nil {
-			return nil, err
-		}
-
-		branches = append(branches, branch{name: parts[1], desc: desc})
+		branches = append(branches, parts[1])
 	}
 	return branches, nil
 }
 
-// checkout checks out the given branch.
-func (g git) checkout(branch string) error {
-	return run(g.sourceDir, "git", "checkout", branch)
+func (g cliGit) remoteRefs() (map[string]string, error) {
+	lines, err := g.runOut("ls-remote", "--heads", "--tags", "--refs", "origin")
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("failed to parse ref line: %s", line)
+		}
+		refs[parts[1]] = parts[0]
+	}
+	return refs, nil
+}
+
+func (g cliGit) checkout(name string) error {
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid ref name: %s", name)
+	}
+	// The "--" makes git take the name only as a branch or tag.
+	return g.run("checkout", name, "--")
 }
 
 // describe returns the output of "git describe" on the given ref
-func (g git) describe(ref string) (string, error) {
-	lines, err := runOut(g.sourceDir, "git", "describe", "--tags", ref)
+func (g cliGit) describe(ref string) (string, error) {
+	args := []string{"describe", "--tags", ref}
+	if g.shallow {
+		// The tags might be out of reach of a shallow history.
+		args = append(args, "--always")
+	}
+	lines, err := g.runOut(args...)
 	if err != nil {
 		return "", err
 	}
@@ -195,3 +409,110 @@ func (g git) describe(ref string) (string, error) {
 	}
 	return lines[0], nil
 }
+
+// commit returns the hash of the checked out commit.
+func (g cliGit) commit() (string, error) {
+	lines, err := g.runOut("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return lines[0], nil
+}
+
+// commitInfo returns the author and the subject of the checked out commit.
+func (g cliGit) commitInfo() (string, string, error) {
+	lines, err := g.runOut("log", "-1", "--format=%an%n%s")
+	if err != nil {
+		return "", "", err
+	}
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("log: wrong output lines count (%v)", lines)
+	}
+	return lines[0], lines[1], nil
+}
+
+// clone clones the repository into the source directory.
+func (g cliGit) clone(r *storage.Remote) error {
+	args := []string{"clone", "--branch", r.Branch}
+	if r.Depth > 0 {
+		// A shallow clone has only the given branch by default.
+		args = append(args, "--depth", strconv.Itoa(r.Depth), "--no-single-branch")
+	}
+	if r.Filter != "" {
+		args = append(args, "--filter", r.Filter)
+	}
+	args = append(args, r.URL, path.Base(g.sourceDir))
+	err := os.MkdirAll(path.Dir(g.sourceDir), 0777)
+	if err != nil {
+		return err
+	}
+	_, err = g.execIn(path.Dir(g.sourceDir), args, false)
+	return err
+}
+
+// valid returns true if the source directory has a usable clone.
+func (g cliGit) check() error {
+	if err := missingClone(g.sourceDir); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return err
+	}
+	lines, err := g.runOut("rev-parse", "--show-toplevel")
+	if err == nil {
+		_, err = g.runOut("rev-parse", "--verify", "HEAD^{commit}")
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "dubious ownership") {
+			// Not trusted by git, but otherwise fine.
+			return err
+		}
+		// Only a failed check of the repository proves it's broken.
+		_, ferr := g.runOut("fsck", "--connectivity-only", "--no-dangling")
+		if ferr != nil {
+			return &noCloneError{"git fsck failed: " + ferr.Error()}
+		}
+		return err
+	}
+	top, err := filepath.Abs(g.sourceDir)
+	if err == nil {
+		top, err = filepath.EvalSymlinks(top)
+	}
+	if err != nil {
+		return err
+	}
+	if lines[0] != top {
+		return &noCloneError{"the clone's top directory is " + lines[0]}
+	}
+	return nil
+}
+
+// noCloneError tells why a directory has no usable clone.
+type noCloneError struct {
+	reason string
+}
+
+func (e *noCloneError) Error() string {
+	return "no usable clone: " + e.reason
+}
+
+// missingClone returns a *noCloneError if the directory or its .git
+// is missing.
+func missingClone(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return &noCloneError{"no source directory"}
+	}
+	if _, err := os.Stat(dir + "/.git"); os.IsNotExist(err) {
+		return &noCloneError{".git is missing"}
+	}
+	return nil
+}
+
+// setRemote points the origin remote to the given URL if it's different.
+func (g cliGit) setRemote(url string) error {
+	lines, err := g.runOut("remote", "get-url", "origin")
+	if err == nil && lines[0] == url {
+		return nil
+	}
+	return g.run("remote", "set-url", "origin", url)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// tagHistory makes a history with branches, merges, several tags on one
+// commit, more tags than describe looks at, commits with equal dates and
+// a commit older than its parent, and pushes it all.
+func tagHistory(t *testing.T, work string) {
+	t.Helper()
+	date := func(s string) {
+		os.Setenv("GIT_COMMITTER_DATE", s+" +0000")
+	}
+	defer os.Unsetenv("GIT_COMMITTER_DATE")
+	run := func(args ...string) {
+		runGit(t, work, args...)
+	}
+
+	date("@1600000000")
+	run("tag", "1.0.0")
+	commit(t, work, "a1")
+	run("tag", "zz")
+	run("tag", "-a", "-m", "1.1.0", "1.1.0")
+
+	run("checkout", "-q", "-b", "dev")
+	commit(t, work, "d1")
+	run("tag", "1.3.0")
+	run("tag", "1.3.0-1")
+	commit(t, work, "d2")
+
+	run("checkout", "-q", "master")
+	date("@1600000100")
+	commit(t, work, "a2")
+	run("tag", "-a", "-m", "2.0.0", "2.0.0")
+	date("@1600000200")
+	run("tag", "-a", "-m", "1.9.0", "1.9.0")
+	run("merge", "-q", "--no-ff", "-m", "merge dev", "dev")
+	commit(t, work, "a3")
+
+	run("checkout", "-q", "-b", "dev-many", "1.0.0")
+	for i := 0; i < 12; i++ {
+		commit(t, work, "m")
+		run("tag", "0.0."+string(rune('a'+i)))
+	}
+	commit(t, work, "m")
+	run("checkout", "-q", "master")
+	run("merge", "-q", "--no-ff", "-m", "merge dev-many", "dev-many")
+
+	run("checkout", "-q", "-b", "dev-skew", "1.1.0")
+	date("@1700000000")
+	commit(t, work, "s1")
+	date("@1500000000")
+	commit(t, work, "s2")
+	run("tag", "1.4.0")
+	date("@1700000000")
+	commit(t, work, "s3")
+	run("checkout", "-q", "master")
+	run("merge", "-q", "--no-ff", "-m", "merge dev-skew", "dev-skew")
+	commit(t, work, "a4")
+
+	run("push", "-q", "origin", "--all")
+	run("push", "-q", "origin", "--tags")
+}
+
+// goGit names every commit the same way as "git describe --tags".
+func TestDescribe(t *testing.T) {
+	_, work := gitRepo(t)
+	tagHistory(t, work)
+	g := goGit{sourceDir: work}
+	refs := strings.Split(runGit(t, work, "rev-list", "--all"), "\n")
+	refs = append(refs, "HEAD", "dev", "1.1.0", "1.9.0", "1.3.0-1")
+	for _, ref := range refs {
+		want := runGit(t, work, "describe", "--tags", "--abbrev=7", ref)
+		got, err := g.describe(ref)
+		if err != nil {
+			t.Errorf("%s: %v", ref, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %s, want %s", ref, got, want)
+		}
+	}
+}
+
+// goGit picks the same tag as "git describe --tags" when lightweight and
+// annotated tags compete and when tags are at equal distances.
+func TestDescribeTies(t *testing.T) {
+	for name, history := range map[string][]string{
+		// The lightweight tag is closer, the annotated one is on the same commit as another.
+		"lightweight and annotated": {
+			"commit", "tag -a -m a 1.0.0", "tag 1.0.0-light", "tag 0.9.0",
+			"commit", "tag 1.1.0", "commit",
+		},
+		// Two annotated tags on one commit with the same date.
+		"annotated twins": {
+			"commit", "tag -a -m b b-tag", "tag -a -m a a-tag", "commit",
+		},
+		// A merge of two branches with a tag one commit down each.
+		"equal distances": {
+			"commit", "checkout -q -b side", "commit", "tag side-1",
+			"checkout -q master", "date @1600000300", "commit", "tag -a -m main main-1",
+			"merge -q --no-ff -m merge side", "commit",
+		},
+		// The same, with all the commits made at once.
+		"equal distances and dates": {
+			"commit", "checkout -q -b side", "commit", "tag side-1",
+			"checkout -q master", "commit", "tag main-1",
+			"merge -q --no-ff -m merge side", "commit",
+		},
+		// One side is longer, but its tag is newer.
+		"longer side": {
+			"commit", "tag 1.0.0", "checkout -q -b side", "commit", "commit", "tag 2.0.0",
+			"checkout -q master", "commit", "tag 1.1.0", "merge -q --no-ff -m merge side",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, work := gitRepo(t)
+			os.Setenv("GIT_COMMITTER_DATE", "@1600000000 +0000")
+			defer os.Unsetenv("GIT_COMMITTER_DATE")
+			// Every commit has a tag to be described by.
+			runGit(t, work, "tag", "base")
+			for _, step := range history {
+				args := strings.Fields(step)
+				switch args[0] {
+				case "commit":
+					commit(t, work, "c")
+				case "date":
+					os.Setenv("GIT_COMMITTER_DATE", args[1]+" +0000")
+				default:
+					runGit(t, work, args...)
+				}
+			}
+			g := goGit{sourceDir: work}
+			for _, ref := range strings.Split(runGit(t, work, "rev-list", "--all"), "\n") {
+				want := runGit(t, work, "describe", "--tags", "--abbrev=7", ref)
+				got, err := g.describe(ref)
+				if err != nil {
+					t.Errorf("%s: %v", ref, err)
+				} else if got != want {
+					t.Errorf("%s: got %s, want %s", ref, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Both backends see the same clone the same way.
+func TestGitBackends(t *testing.T) {
+	bare, work := gitRepo(t)
+	tagHistory(t, work)
+	root := t.TempDir()
+	backends := []git{cliGit{sourceDir: root + "/git"}, goGit{sourceDir: root + "/go-git"}}
+	for _, g := range backends {
+		if err := g.clone(&storage.Remote{URL: bare, Branch: "master"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	same := func(what string, want interface{}, f func(g git) (interface{}, error)) {
+		t.Helper()
+		for _, g := range backends {
+			got, err := f(g)
+			if err != nil {
+				t.Errorf("%T %s: %v", g, what, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%T %s: got %v, want %v", g, what, got, want)
+			}
+		}
+	}
+	branches := func(g git) (interface{}, error) {
+		return g.branches()
+	}
+	tags := func(g git) (interface{}, error) {
+		return g.tags()
+	}
+	same("branches", []string{"dev", "dev-many", "dev-skew", "master"}, branches)
+	same("tags", []string{"1.0.0", "1.1.0", "1.3.0", "1.3.0-1", "1.4.0", "1.9.0", "2.0.0"}, tags)
+	for _, ref := range []string{"origin/master", "origin/dev", "origin/dev-skew", "1.1.0"} {
+		want := runGit(t, work, "describe", "--tags", "--abbrev=7", strings.TrimPrefix(ref, "origin/"))
+		same("describe "+ref, want, func(g git) (interface{}, error) {
+			return g.describe(ref)
+		})
+	}
+	for _, ref := range []string{"dev", "1.3.0", "master"} {
+		want := runGit(t, work, "rev-parse", ref+"^{commit}")
+		same("checkout "+ref, want, func(g git) (interface{}, error) {
+			if err := g.checkout(ref); err != nil {
+				return nil, err
+			}
+			return g.commit()
+		})
+	}
+
+	// Tags and branches deleted upstream are deleted by fetch.
+	runGit(t, work, "push", "-q", "origin", ":refs/tags/1.0.0", ":refs/tags/zz", ":dev-skew")
+	runGit(t, work, "checkout", "-q", "master")
+	head := commit(t, work, "a5")
+	runGit(t, work, "tag", "3.0.0")
+	runGit(t, work, "push", "-q", "origin", "master", "3.0.0")
+	same("fetch", nil, func(g git) (interface{}, error) {
+		refs, err := g.remoteRefs()
+		if err != nil {
+			return nil, err
+		}
+		return nil, g.fetch(refs, []string{"refs/heads/master", "refs/tags/3.0.0"})
+	})
+	same("branches", []string{"dev", "dev-many", "master"}, branches)
+	same("tags", []string{"1.1.0", "1.3.0", "1.3.0-1", "1.4.0", "1.9.0", "2.0.0", "3.0.0"}, tags)
+
+	// Tags are pruned by the given refs, without asking the remote again.
+	same("fetch with old refs", nil, func(g git) (interface{}, error) {
+		refs, err := g.remoteRefs()
+		if err != nil {
+			return nil, err
+		}
+		delete(refs, "refs/tags/2.0.0")
+		return nil, g.fetch(refs, nil)
+	})
+	same("tags", []string{"1.1.0", "1.3.0", "1.3.0-1", "1.4.0", "1.9.0", "3.0.0"}, tags)
+	same("pull", head, func(g git) (interface{}, error) {
+		if err := g.pull(); err != nil {
+			return nil, err
+		}
+		return g.commit()
+	})
+	same("describe", "3.0.0", func(g git) (interface{}, error) {
+		return g.describe("HEAD")
+	})
+
+	// Only the given refs are fetched.
+	runGit(t, work, "checkout", "-q", "dev")
+	dev := commit(t, work, "d3")
+	runGit(t, work, "tag", "4.0.0")
+	runGit(t, work, "checkout", "-q", "master")
+	commit(t, work, "a6")
+	runGit(t, work, "push", "-q", "origin", "master", "dev", "4.0.0")
+	same("fetch dev", dev, func(g git) (interface{}, error) {
+		refs, err := g.remoteRefs()
+		if err != nil {
+			return nil, err
+		}
+		if err := g.fetch(refs, []string{"refs/heads/dev"}); err != nil {
+			return nil, err
+		}
+		if h := runGit(t, g.dir(), "rev-parse", "origin/master"); h != head {
+			t.Errorf("%T: master is fetched too", g)
+		}
+		if runGit(t, g.dir(), "tag", "-l", "4.0.0") != "" {
+			t.Errorf("%T: the tag is fetched too", g)
+		}
+		return runGit(t, g.dir(), "rev-parse", "origin/dev"), nil
+	})
+}
+
+func TestValidRefName(t *testing.T) {
+	valid := []string{"master", "feature/login", "1.0.0", "release-1.2", "ветка", "a.b", "dev_1", "x@y"}
+	invalid := []string{"", "-x", "--force", "a..b", "../etc", "/master", "master/", "a//b",
+		"a.", ".hidden", "dir/.hidden", "x.lock", "dir/x.lock/y", "a b", "a~1", "a^", "a:b",
+		"a?", "a*", "a[b", "a\\b", "a@{1}", "@", "a\x00b", "a\tb", "a\x7fb"}
+	for _, name := range valid {
+		if !validRefName(name) {
+			t.Errorf("%q is rejected", name)
+		}
+	}
+	for _, name := range invalid {
+		if validRefName(name) {
+			t.Errorf("%q is accepted", name)
+		}
+	}
+}
+
+// A name that looks like an option never gets to git as one.
+func TestCheckoutOption(t *testing.T) {
+	bare, _ := gitRepo(t)
+	g := cliGit{sourceDir: t.TempDir() + "/src"}
+	if err := g.clone(&storage.Remote{URL: bare, Branch: "master"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"-b", "--orphan=x", "--", "."} {
+		if err := g.checkout(name); err == nil {
+			t.Errorf("checkout %q worked", name)
+		}
+	}
+	if err := g.checkout("master"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBranchIsBuildable(t *testing.T) {
+	tests := []struct {
+		branch, defaultBranch string
+		want                  bool
+	}{
+		{"master", "", true},
+		{"develop", "", true},
+		{"dev/feature", "", true},
+		{"butler", "", true},
+		{"main", "main", true},
+		{"main", "", false},
+		{"feature/login", "main", false},
+		// Its builds would end up among the releases.
+		{storage.ReleasesDirectory, "", false},
+		{storage.ReleasesDirectory, storage.ReleasesDirectory, false},
+	}
+	for _, tt := range tests {
+		if got := branchIsBuildable(tt.branch, tt.defaultBranch); got != tt.want {
+			t.Errorf("branchIsBuildable(%q, %q) = %v", tt.branch, tt.defaultBranch, got)
+		}
+	}
+}
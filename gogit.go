@@ -0,0 +1,678 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// goGit works with clones using go-git instead of the git program.
+type goGit struct {
+	sourceDir string
+
+	// log receives the progress of network operations.
+	log io.Writer
+
+	// auth has the credentials for the remote.
+	auth transport.AuthMethod
+
+	// defaultBranch is built in addition to the usual branches.
+	defaultBranch string
+
+	// shallow is true if the clone has only part of the history.
+	shallow bool
+}
+
+func (g goGit) dir() string {
+	return g.sourceDir
+}
+
+func (g goGit) open() (*gogit.Repository, error) {
+	return gogit.PlainOpen(g.sourceDir)
+}
+
+func (g goGit) clone(r *storage.Remote) error {
+	if r.Filter != "" {
+		return fmt.Errorf("partial clones are not supported by go-git")
+	}
+	_, err := gogit.PlainClone(g.sourceDir, false, &gogit.CloneOptions{
+		URL:           r.URL,
+		Auth:          g.auth,
+		ReferenceName: plumbing.NewBranchReferenceName(r.Branch),
+		Depth:         r.Depth,
+		Tags:          gogit.AllTags,
+		Progress:      g.log,
+	})
+	return err
+}
+
+func (g goGit) check() error {
+	if err := missingClone(g.sourceDir); err != nil {
+		return err
+	}
+	repo, err := g.open()
+	if err == gogit.ErrRepositoryNotExists {
+		return &noCloneError{err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err == nil {
+		_, err = repo.CommitObject(head.Hash())
+	}
+	if err != nil {
+		// Only a failed check of the repository proves it's broken.
+		if ferr := g.fsck(repo); ferr != nil {
+			return &noCloneError{"the repository is broken: " + ferr.Error()}
+		}
+		return err
+	}
+	return nil
+}
+
+// fsck works like "git fsck --connectivity-only": it checks that the objects
+// reachable from HEAD and the refs are there and readable. Blobs are only
+// looked up, not read.
+func (g goGit) fsck(repo *gogit.Repository) error {
+	todo := make([]plumbing.Hash, 0)
+	head, err := repo.Reference(plumbing.HEAD, true)
+	if err == nil {
+		todo = append(todo, head.Hash())
+	} else if err != plumbing.ErrReferenceNotFound {
+		// An unborn branch is fine, as it is for git.
+		return fmt.Errorf("HEAD: %v", err)
+	}
+	iter, err := repo.References()
+	if err != nil {
+		return err
+	}
+	err = iter.ForEach(func(r *plumbing.Reference) error {
+		if r.Type() == plumbing.HashReference {
+			todo = append(todo, r.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	shallow := make(map[plumbing.Hash]bool)
+	hashes, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		shallow[h] = true
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	for len(todo) > 0 {
+		h := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return fmt.Errorf("object %s: %v", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(repo.Storer, obj)
+			if err != nil {
+				return fmt.Errorf("commit %s: %v", h, err)
+			}
+			todo = append(todo, c.TreeHash)
+			// The parents of the oldest commits of a shallow clone aren't there.
+			if !shallow[h] {
+				todo = append(todo, c.ParentHashes...)
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(repo.Storer, obj)
+			if err != nil {
+				return fmt.Errorf("tag %s: %v", h, err)
+			}
+			todo = append(todo, t.Target)
+		case plumbing.TreeObject:
+			t, err := object.DecodeTree(repo.Storer, obj)
+			if err != nil {
+				return fmt.Errorf("tree %s: %v", h, err)
+			}
+			for _, e := range t.Entries {
+				switch {
+				case e.Mode == filemode.Submodule:
+					// The commit is in another repository.
+				case e.Mode == filemode.Dir:
+					todo = append(todo, e.Hash)
+				default:
+					if err := repo.Storer.HasEncodedObject(e.Hash); err != nil {
+						return fmt.Errorf("blob %s: %v", e.Hash, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (g goGit) setRemote(url string) error {
+	repo, err := g.open()
+	if err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	rc, ok := cfg.Remotes["origin"]
+	if !ok {
+		_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+		return err
+	}
+	if len(rc.URLs) == 1 && rc.URLs[0] == url {
+		return nil
+	}
+	rc.URLs = []string{url}
+	return repo.SetConfig(cfg)
+}
+
+func (g goGit) fetch(refs map[string]string, names []string) error {
+	repo, err := g.open()
+	if err != nil {
+		return err
+	}
+	specs := make([]gitconfig.RefSpec, 0)
+	for _, s := range refspecs(refs, names) {
+		specs = append(specs, gitconfig.RefSpec(s))
+	}
+	if len(specs) > 0 {
+		err = repo.Fetch(&gogit.FetchOptions{
+			RemoteName: "origin",
+			RefSpecs:   specs,
+			Auth:       g.auth,
+			Tags:       gogit.NoTags,
+			Progress:   g.log,
+		})
+		if err != nil && err != gogit.NoErrAlreadyUpToDate {
+			return err
+		}
+	}
+
+	// Delete the branches that were deleted on the remote.
+	iter, err := repo.References()
+	if err != nil {
+		return err
+	}
+	gone := make([]plumbing.ReferenceName, 0)
+	err = iter.ForEach(func(r *plumbing.Reference) error {
+		name := r.Name().String()
+		branch := strings.TrimPrefix(name, "refs/remotes/origin/")
+		if branch == name || branch == "HEAD" {
+			return nil
+		}
+		if _, ok := refs["refs/heads/"+branch]; !ok {
+			gone = append(gone, r.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range gone {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return fmt.Errorf("failed to delete branch %s: %v", name.Short(), err)
+		}
+	}
+
+	// Delete the tags that were deleted on the remote.
+	local, err := g.allTags(repo)
+	if err != nil {
+		return err
+	}
+	for name := range local {
+		if _, ok := refs["refs/tags/"+name]; ok {
+			continue
+		}
+		err := repo.DeleteTag(name)
+		if err != nil {
+			return fmt.Errorf("failed to delete tag %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// allTags returns the commits of all tags by their names.
+func (g goGit) allTags(repo *gogit.Repository) (map[string]plumbing.Hash, error) {
+	iter, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]plumbing.Hash)
+	err = iter.ForEach(func(r *plumbing.Reference) error {
+		h := r.Hash()
+		// Annotated tags point to tag objects rather than commits.
+		if t, err := repo.TagObject(h); err == nil {
+			h = t.Target
+		}
+		tags[r.Name().Short()] = h
+		return nil
+	})
+	return tags, err
+}
+
+func (g goGit) branches() ([]string, error) {
+	repo, err := g.open()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	err = iter.ForEach(func(r *plumbing.Reference) error {
+		if !r.Name().IsRemote() || r.Type() != plumbing.HashReference {
+			return nil
+		}
+		parts := strings.SplitN(r.Name().Short(), "/", 2)
+		if len(parts) != 2 || parts[0] != "origin" || parts[1] == "HEAD" {
+			return nil
+		}
+		if branchIsBuildable(parts[1], g.defaultBranch) {
+			names = append(names, parts[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (g goGit) remoteRefs() (map[string]string, error) {
+	repo, err := g.open()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, err
+	}
+	list, err := remote.List(&gogit.ListOptions{Auth: g.auth})
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, r := range list {
+		if (r.Name().IsBranch() || r.Name().IsTag()) && r.Type() == plumbing.HashReference {
+			refs[r.Name().String()] = r.Hash().String()
+		}
+	}
+	return refs, nil
+}
+
+func (g goGit) tags() ([]string, error) {
+	repo, err := g.open()
+	if err != nil {
+		return nil, err
+	}
+	all, err := g.allTags(repo)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0)
+	for name := range all {
+		if versionTag.MatchString(name) {
+			versions = append(versions, name)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionLess(versions[i], versions[j])
+	})
+	return versions, nil
+}
+
+var numbers = regexp.MustCompile(`\d+`)
+
+// versionLess compares version tags by their numbers,
+// like "git tag --sort v:refname" does.
+func versionLess(a, b string) bool {
+	x := numbers.FindAllString(a, -1)
+	y := numbers.FindAllString(b, -1)
+	for i := 0; i < len(x) && i < len(y); i++ {
+		m, _ := strconv.Atoi(x[i])
+		n, _ := strconv.Atoi(y[i])
+		if m != n {
+			return m < n
+		}
+	}
+	return len(x) < len(y)
+}
+
+// describeTag is a tag that describe can name commits after.
+type describeTag struct {
+	name      string
+	annotated bool
+	date      time.Time
+}
+
+// describeTags returns the tags by the commits they point to. Of several
+// tags on one commit it keeps the one "git describe" takes: annotated tags
+// win over lightweight ones, the newer of two annotated tags wins, and
+// otherwise the first by name wins.
+func (g goGit) describeTags(repo *gogit.Repository) (map[plumbing.Hash]describeTag, error) {
+	iter, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*plumbing.Reference, 0)
+	err = iter.ForEach(func(r *plumbing.Reference) error {
+		refs = append(refs, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name() < refs[j].Name()
+	})
+	tags := make(map[plumbing.Hash]describeTag)
+	for _, r := range refs {
+		t := describeTag{name: r.Name().Short()}
+		h := r.Hash()
+		for {
+			obj, err := repo.TagObject(h)
+			if err != nil {
+				break
+			}
+			if !t.annotated {
+				t.annotated = true
+				t.date = obj.Tagger.When
+			}
+			h = obj.Target
+		}
+		old, ok := tags[h]
+		if !ok || (t.annotated && !old.annotated) || (t.annotated && old.annotated && old.date.Before(t.date)) {
+			tags[h] = t
+		}
+	}
+	return tags, nil
+}
+
+// describeCandidates is how many tags describe looks at, like git does by default.
+const describeCandidates = 10
+
+// describeCandidate is a tag found by describe with the number of commits
+// seen so far that are not in the tag's history.
+type describeCandidate struct {
+	tag   describeTag
+	depth int
+	flag  uint
+}
+
+// describe works like "git describe --tags": it walks the history newest
+// commits first, takes the first tags it meets as candidates and names the
+// commit after the one with the fewest commits not in its history, or the
+// first one found if there's a tie. The walk stops once the remaining
+// commits can't change the answer.
+func (g goGit) describe(ref string) (string, error) {
+	repo, err := g.open()
+	if err != nil {
+		return "", err
+	}
+	h, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return "", err
+	}
+	tags, err := g.describeTags(repo)
+	if err != nil {
+		return "", err
+	}
+	if t, ok := tags[*h]; ok {
+		return t.name, nil
+	}
+	start, err := repo.CommitObject(*h)
+	if err != nil {
+		return "", err
+	}
+
+	w := &describeWalk{
+		repo:  repo,
+		queue: []*object.Commit{start},
+		seen:  map[plumbing.Hash]bool{start.Hash: true},
+		flags: make(map[plumbing.Hash]uint),
+	}
+	candidates := make([]*describeCandidate, 0)
+	annotated := false
+	seen := 0
+	var gaveUp *object.Commit
+	for len(w.queue) > 0 {
+		c := w.pop()
+		seen++
+		if t, ok := tags[c.Hash]; ok {
+			if len(candidates) == describeCandidates {
+				gaveUp = c
+				break
+			}
+			d := &describeCandidate{tag: t, depth: seen - 1, flag: 1 << uint(len(candidates))}
+			candidates = append(candidates, d)
+			w.flags[c.Hash] |= d.flag
+			annotated = annotated || t.annotated
+		}
+		for _, d := range candidates {
+			if w.flags[c.Hash]&d.flag == 0 {
+				d.depth++
+			}
+		}
+		// The only path left is already covered by the candidates.
+		if annotated && len(w.queue) == 0 {
+			break
+		}
+		if err := w.parents(c); err != nil {
+			return "", err
+		}
+	}
+	if len(candidates) == 0 {
+		if g.shallow {
+			// The tags might be out of reach of a shallow history.
+			return h.String()[:7], nil
+		}
+		return "", fmt.Errorf("no tags can describe %s", ref)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].depth < candidates[j].depth
+	})
+	best := candidates[0]
+
+	// Count the rest of the commits not in the best tag's history,
+	// until only the tag's history is left to walk.
+	if gaveUp != nil {
+		w.push(gaveUp)
+	}
+	for len(w.queue) > 0 {
+		c := w.pop()
+		if w.flags[c.Hash]&best.flag != 0 {
+			if w.all(best.flag) {
+				break
+			}
+		} else {
+			best.depth++
+		}
+		if err := w.parents(c); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s-%d-g%s", best.tag.name, best.depth, h.String()[:7]), nil
+}
+
+// describeWalk keeps the commits that describe has yet to visit, newest
+// first and in the order they were added if the dates are equal, like
+// git does. The counts depend on that order, which is why go-git's
+// commit iterators, which don't keep it for equal dates, aren't used.
+// Every commit has flags of the candidate tags whose history it's in.
+type describeWalk struct {
+	repo  *gogit.Repository
+	queue []*object.Commit
+	seen  map[plumbing.Hash]bool
+	flags map[plumbing.Hash]uint
+}
+
+func (w *describeWalk) pop() *object.Commit {
+	c := w.queue[0]
+	w.queue = w.queue[1:]
+	return c
+}
+
+func (w *describeWalk) push(c *object.Commit) {
+	i := 0
+	for i < len(w.queue) && !w.queue[i].Committer.When.Before(c.Committer.When) {
+		i++
+	}
+	w.queue = append(w.queue, nil)
+	copy(w.queue[i+1:], w.queue[i:])
+	w.queue[i] = c
+}
+
+// parents queues the parents of the commit that haven't been queued yet
+// and passes the commit's flags to them. Parents missing from a shallow
+// clone are skipped.
+func (w *describeWalk) parents(c *object.Commit) error {
+	for _, h := range c.ParentHashes {
+		if !w.seen[h] {
+			p, err := w.repo.CommitObject(h)
+			if err == plumbing.ErrObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			w.seen[h] = true
+			w.push(p)
+		}
+		w.flags[h] |= w.flags[c.Hash]
+	}
+	return nil
+}
+
+// all returns true if all the queued commits have the flag.
+func (w *describeWalk) all(flag uint) bool {
+	for _, c := range w.queue {
+		if w.flags[c.Hash]&flag == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g goGit) checkout(name string) error {
+	repo, err := g.open()
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	local := plumbing.NewBranchReferenceName(name)
+	if _, err := repo.Reference(local, false); err == nil {
+		return wt.Checkout(&gogit.CheckoutOptions{Branch: local, Force: true})
+	}
+	if r, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", name), true); err == nil {
+		return wt.Checkout(&gogit.CheckoutOptions{Branch: local, Hash: r.Hash(), Create: true, Force: true})
+	}
+	all, err := g.allTags(repo)
+	if err != nil {
+		return err
+	}
+	if h, ok := all[name]; ok {
+		return wt.Checkout(&gogit.CheckoutOptions{Hash: h, Force: true})
+	}
+	return fmt.Errorf("no branch or tag %s", name)
+}
+
+// pull moves the checked out branch to the fetched remote branch.
+func (g goGit) pull() error {
+	repo, err := g.open()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if !head.Name().IsBranch() {
+		return nil
+	}
+	r, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return wt.Reset(&gogit.ResetOptions{Commit: r.Hash(), Mode: gogit.HardReset})
+}
+
+func (g goGit) discard() error {
+	repo, err := g.open()
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	err = wt.Reset(&gogit.ResetOptions{Mode: gogit.HardReset})
+	if err != nil {
+		return err
+	}
+	return wt.Clean(&gogit.CleanOptions{Dir: true})
+}
+
+func (g goGit) commit() (string, error) {
+	repo, err := g.open()
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+func (g goGit) commitInfo() (string, string, error) {
+	repo, err := g.open()
+	if err != nil {
+		return "", "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", "", err
+	}
+	c, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", "", err
+	}
+	subject := strings.SplitN(strings.TrimSpace(c.Message), "\n", 2)[0]
+	return c.Author.Name, subject, nil
+}
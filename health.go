@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// updates keeps track of the update loop and the projects it updates.
+var updates = &updateTracker{
+	heartbeat: time.Now(),
+	projects:  make(map[string]projectUpdate),
+}
+
+// loopTimeout is how long the update loop may go without progress
+// while nothing is being built before it's considered stuck.
+const loopTimeout = 30 * time.Minute
+
+// ready is set once the server has started up.
+var ready atomic.Bool
+
+type updateTracker struct {
+	mu        sync.Mutex
+	heartbeat time.Time
+	projects  map[string]projectUpdate
+}
+
+// projectUpdate is the outcome of the latest updates of a project.
+type projectUpdate struct {
+	Project string
+	// LastPoll is the time of the last successful update.
+	LastPoll time.Time
+	// LastAttempt is the time of the last update, successful or not.
+	LastAttempt time.Time
+	// Error is the error of the last update if it failed.
+	Error  string
+	Failed time.Time
+	// Failures is how many updates in a row have failed.
+	Failures int
+	// Next is when the project is to be updated again.
+	Next time.Time
+}
+
+// A project whose update has failed waits failureBackoff before the next
+// one, twice as long after every further failure in a row, but no longer
+// than maxFailureBackoff, and never less than its poll interval.
+const (
+	failureBackoff    = time.Minute
+	maxFailureBackoff = 30 * time.Minute
+)
+
+// beat records that the update loop is making progress.
+func (u *updateTracker) beat() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.heartbeat = time.Now()
+}
+
+// lastBeat returns when the update loop last made progress.
+func (u *updateTracker) lastBeat() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.heartbeat
+}
+
+// record records the outcome of an update of the project and schedules
+// the next one after the given interval, or later if the update failed.
+func (u *updateTracker) record(project string, interval time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p := u.projects[project]
+	p.Project = project
+	p.LastAttempt = time.Now()
+	if err != nil {
+		p.Error = err.Error()
+		p.Failed = time.Now()
+		p.Failures++
+		if b := backoff(p.Failures); b > interval {
+			interval = b
+		}
+	} else {
+		p.Error = ""
+		p.LastPoll = time.Now()
+		p.Failures = 0
+	}
+	p.Next = p.LastAttempt.Add(jitter(interval))
+	u.projects[project] = p
+}
+
+// backoff returns how long to wait after the given number of failed
+// updates in a row.
+func backoff(failures int) time.Duration {
+	d := failureBackoff
+	for i := 1; i < failures && d < maxFailureBackoff; i++ {
+		d *= 2
+	}
+	if d > maxFailureBackoff {
+		d = maxFailureBackoff
+	}
+	return d
+}
+
+// due returns true if it's time to update the project.
+func (u *updateTracker) due(project string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !time.Now().Before(u.projects[project].Next)
+}
+
+// jitter randomly changes the interval by up to a tenth, so that
+// projects with the same interval don't all poll at the same time.
+func jitter(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	spread := int64(interval / 5)
+	if spread == 0 {
+		return interval
+	}
+	return interval - time.Duration(spread/2) + time.Duration(rand.Int63n(spread))
+}
+
+// list returns the latest updates of all projects.
+func (u *updateTracker) list() []projectUpdate {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	list := make([]projectUpdate, 0, len(u.projects))
+	for _, p := range u.projects {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Project < list[j].Project
+	})
+	return list
+}
+
+// loopAlive returns true if the update loop isn't stuck. A long build
+// holds the loop up, so it's alive as long as something is being built.
+func loopAlive() bool {
+	return time.Since(updates.lastBeat()) < loopTimeout || len(running.list()) > 0
+}
+
+func healthz(w http.ResponseWriter) {
+	if !loopAlive() {
+		statusPage(w, 503, "The update loop is stuck")
+		return
+	}
+	statusPage(w, 200, "ok")
+}
+
+func readyz(w http.ResponseWriter) {
+	if !ready.Load() {
+		statusPage(w, 503, "Starting up")
+		return
+	}
+	_, err := storage.Projects()
+	if err != nil {
+		statusPage(w, 503, err.Error())
+		return
+	}
+	statusPage(w, 200, "ok")
+}
+
+// tools are the programs butler and the builders run.
+var tools = []struct {
+	Name    string
+	Purpose string
+}{
+	{"git", "getting the sources"},
+	{"java", "Android builds"},
+	{"node", "React Native builds"},
+	{"npm", "React Native builds"},
+	{"yarn", "React Native builds with yarn.lock"},
+	{"sh", "butler.sh builds"},
+}
+
+type toolStatus struct {
+	Name    string
+	Purpose string
+	Path    string
+	Error   string
+}
+
+type diskStatus struct {
+	Dir   string
+	Free  uint64
+	Error string
+}
+
+type diagnosticsPage struct {
+	LoopAlive bool
+	LastBeat  time.Time
+	Running   int
+	Queued    int
+	Tools     []toolStatus
+	Disks     []diskStatus
+	Projects  []projectUpdate
+}
+
+func diagnostics(w http.ResponseWriter) {
+	page := diagnosticsPage{
+		LoopAlive: loopAlive(),
+		LastBeat:  updates.lastBeat(),
+		Running:   len(running.list()),
+		Queued:    queue.len(),
+		Projects:  updates.list(),
+	}
+	for _, t := range tools {
+		s := toolStatus{Name: t.Name, Purpose: t.Purpose}
+		p, err := exec.LookPath(t.Name)
+		if err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Path = p
+		}
+		page.Tools = append(page.Tools, s)
+	}
+	for _, dir := range []string{"projects", "tmp"} {
+		s := diskStatus{Dir: dir}
+		free, err := diskFree(dir)
+		if err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Free = free
+		}
+		page.Disks = append(page.Disks, s)
+	}
+	render(w, "diagnostics", page)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withUpdates replaces the update tracker for the rest of the test.
+func withUpdates(t *testing.T, heartbeat time.Time) {
+	t.Helper()
+	saved := updates
+	updates = &updateTracker{heartbeat: heartbeat, projects: make(map[string]projectUpdate)}
+	t.Cleanup(func() {
+		updates = saved
+	})
+}
+
+func getPath(t *testing.T, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestHealthz(t *testing.T) {
+	withUpdates(t, time.Now().Add(-loopTimeout-time.Minute))
+	if w := getPath(t, "/healthz"); w.Code != 503 {
+		t.Errorf("stuck loop: %d", w.Code)
+	}
+
+	// A long build holds the loop up.
+	b := runningBuild{Project: "app", Ref: ref{name: "master"}, Version: "1.0.0"}
+	running.start(b)
+	if w := getPath(t, "/healthz"); w.Code != 200 {
+		t.Errorf("loop waiting for a build: %d", w.Code)
+	}
+	running.finish(b)
+
+	updates.beat()
+	if w := getPath(t, "/healthz"); w.Code != 200 || w.Body.String() != "ok" {
+		t.Errorf("alive loop: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	inTempDir(t)
+	defer ready.Store(ready.Load())
+	writeFiles(t, map[string]string{"projects/app/project.json": `{}`})
+
+	ready.Store(false)
+	if w := getPath(t, "/readyz"); w.Code != 503 {
+		t.Errorf("starting up: %d", w.Code)
+	}
+	ready.Store(true)
+	if w := getPath(t, "/readyz"); w.Code != 200 {
+		t.Errorf("ready: %d %s", w.Code, w.Body.String())
+	}
+	writeFiles(t, map[string]string{"projects/bad/project.json": `{`})
+	if w := getPath(t, "/readyz"); w.Code != 503 || !strings.Contains(w.Body.String(), "project.json") {
+		t.Errorf("unreadable projects: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{"projects/app/project.json": `{}`})
+	withUpdates(t, time.Now())
+	updates.record("app", time.Minute, nil)
+	updates.record("lib", time.Minute, errors.New("<remote hung up>"))
+
+	w := getPath(t, "/diagnostics")
+	if w.Code != 200 {
+		t.Fatalf("status %d", w.Code)
+	}
+	page := w.Body.String()
+	for _, want := range []string{
+		"alive",
+		"<td>git</td>",
+		"<td>projects</td>",
+		"<td>tmp</td>",
+		">app</a>",
+		// Errors are escaped.
+		"&lt;remote hung up&gt;",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the page doesn't have %q", want)
+		}
+	}
+	if strings.Contains(page, "No updates yet") {
+		t.Error("the updates are not listed")
+	}
+}
+
+func TestUpdateTracker(t *testing.T) {
+	withUpdates(t, time.Now())
+	if !updates.due("app") {
+		t.Error("a new project is not due")
+	}
+	updates.record("app", time.Hour, nil)
+	if updates.due("app") {
+		t.Error("the project is due right after an update")
+	}
+	updates.record("app", time.Hour, errors.New("failed"))
+	updates.record("lib", 0, nil)
+	if !updates.due("lib") {
+		t.Error("a project without an interval is not due")
+	}
+	list := updates.list()
+	if len(list) != 2 || list[0].Project != "app" || list[1].Project != "lib" {
+		t.Fatalf("list = %+v", list)
+	}
+	app := list[0]
+	if app.Error != "failed" || app.LastPoll.IsZero() || app.Failed.Before(app.LastPoll) {
+		t.Errorf("app = %+v, want the error and the earlier successful update", app)
+	}
+	updates.record("app", time.Hour, nil)
+	if app := updates.list()[0]; app.Error != "" || app.Failures != 0 {
+		t.Errorf("the error is kept after a successful update: %+v", app)
+	}
+}
+
+// A failing project waits longer after every failure, and the others
+// are not held up by it.
+func TestUpdateBackoff(t *testing.T) {
+	withUpdates(t, time.Now())
+	wait := func() time.Duration {
+		p := updates.list()[0]
+		return p.Next.Sub(p.LastAttempt)
+	}
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		updates.record("app", 0, errors.New("failed"))
+		if d := wait(); d < want*9/10 || d > want*11/10 {
+			t.Errorf("waits %v, want %v", d, want)
+		}
+		if updates.due("app") {
+			t.Error("a failed project is due right away")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		updates.record("app", 0, errors.New("failed"))
+	}
+	if d := wait(); d > maxFailureBackoff*11/10 {
+		t.Errorf("waits %v, more than %v", d, maxFailureBackoff)
+	}
+	// A longer poll interval is kept.
+	updates.record("app", 2*time.Hour, errors.New("failed"))
+	if d := wait(); d < 108*time.Minute {
+		t.Errorf("waits %v, less than the poll interval", d)
+	}
+	updates.record("app", 0, nil)
+	if !updates.due("app") {
+		t.Error("the project is not due after a successful update")
+	}
+	updates.record("app", 0, errors.New("failed"))
+	if d := wait(); d > 2*time.Minute {
+		t.Errorf("waits %v after a success, want the first backoff", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if jitter(0) != 0 {
+		t.Error("jitter(0) is not 0")
+	}
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Minute)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter(1m) = %v, want within a tenth", d)
+		}
+	}
+}
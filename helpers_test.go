@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// inTempDir runs the rest of the test in a new empty working directory,
+// since butler keeps its files relative to the working directory.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	return dir
+}
+
+// writeFiles creates files with the given contents under the working directory.
+func writeFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		err := os.MkdirAll(filepath.Dir(name), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(name, []byte(data), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runGit runs a git command in the directory with a fixed identity.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	c.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Tester", "GIT_AUTHOR_EMAIL=tester@example.com",
+		"GIT_COMMITTER_NAME=Tester", "GIT_COMMITTER_EMAIL=tester@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+	)
+	out, err := c.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit makes a commit with the given message in the repository.
+func commit(t *testing.T, dir, message string) string {
+	t.Helper()
+	runGit(t, dir, "commit", "--allow-empty", "-q", "-m", message)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+// gitRepo creates a bare repository with one commit on master
+// and returns its path and the path of a working copy that pushes to it.
+func gitRepo(t *testing.T) (string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	root := t.TempDir()
+	bare := root + "/up.git"
+	work := root + "/work"
+	runGit(t, root, "init", "-q", "--bare", "-b", "master", bare)
+	runGit(t, root, "clone", "-q", bare, work)
+	runGit(t, work, "checkout", "-q", "-b", "master")
+	commit(t, work, "first")
+	runGit(t, work, "push", "-q", "origin", "master")
+	return bare, work
+}
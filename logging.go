@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logConfig sets up the server's log.
+type logConfig struct {
+	// Level is the lowest level of messages written:
+	// debug, info (the default), warn or error.
+	Level string `json:"level"`
+
+	// Format is "text" (the default) for logfmt lines or "json".
+	Format string `json:"format"`
+}
+
+// setupLogging makes the default logger write structured messages
+// as configured. Messages written with the standard log package
+// go to the same place.
+func setupLogging(cfg logConfig) error {
+	var level slog.Level
+	switch strings.ToLower(cfg.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return fmt.Errorf("unknown log level: %s", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch cfg.Format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format: %s", cfg.Format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// attr returns the log attribute identifying the ref.
+func (r ref) attr() slog.Attr {
+	if r.isTag {
+		return slog.String("tag", r.name)
+	}
+	return slog.String("branch", r.name)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// buildMeta is information about a build that is given to builders
+// in BUTLER_* environment variables.
+type buildMeta struct {
+	project  string
+	ref      ref
+	commit   string
+	describe string
+	number   int
+
+	// author and message of the commit are not passed to builders,
+	// only saved with the build.
+	author  string
+	message string
+}
+
+// readMeta gets the information about the checked out source of the given
+// ref and allocates a new build number for its build as the given version.
+func readMeta(g git, project string, r ref, version string) (buildMeta, error) {
+	meta := buildMeta{project: project, ref: r}
+	var err error
+	meta.commit, err = g.commit()
+	if err != nil {
+		return meta, err
+	}
+	meta.describe, err = g.describe("HEAD")
+	if err != nil {
+		return meta, err
+	}
+	meta.author, meta.message, err = g.commitInfo()
+	if err != nil {
+		return meta, err
+	}
+	meta.number, err = storage.NewBuildNumber(project, r.directory(), version)
+	if err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+// env returns the variables for a build of the given variant.
+func (m buildMeta) env(variant string) []string {
+	branch, tag := m.ref.name, ""
+	if m.ref.isTag {
+		branch, tag = "", m.ref.name
+	}
+	vars := []string{
+		"BUTLER_PROJECT=" + m.project,
+		"BUTLER_BRANCH=" + branch,
+		"BUTLER_TAG=" + tag,
+		"BUTLER_COMMIT=" + m.commit,
+		"BUTLER_DESCRIBE=" + m.describe,
+		"BUTLER_BUILD_NUMBER=" + strconv.Itoa(m.number),
+		"BUTLER_VARIANT=" + variant,
+	}
+	if version, code, ok := parseDescribe(m.describe); ok {
+		vars = append(vars,
+			"BUTLER_VERSION="+version,
+			"BUTLER_VERSION_CODE="+strconv.Itoa(code),
+		)
+	}
+	return vars
+}
+
+// describeRegexp matches "git describe" outputs for version tags,
+// like "1.2.0", "1.2.0-3" (tag with a bundle number), "1.2.0-14-g3a4b5c6"
+// (14 commits after the tag) and "1.2.0-3-14-g3a4b5c6".
+var describeRegexp = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)(?:-(\d+))?(?:-(\d+)-g[0-9a-f]+)?$`)
+
+// parseDescribe parses a "git describe" output and returns the version
+// and the version code for it. The version code is
+// major*100000000 + minor*1000000 + patch*10000 + bundle*1000 + commits
+// since the tag, so that it grows with every commit, every bundle and every
+// version, and stays below Android's limit of 2100000000.
+// If the output doesn't start with a version tag or the numbers are too big
+// to fit in the code, ok is false.
+func parseDescribe(describe string) (version string, code int, ok bool) {
+	m := describeRegexp.FindStringSubmatch(describe)
+	if m == nil {
+		return "", 0, false
+	}
+	n := make([]int, 6)
+	for i := 1; i < len(m); i++ {
+		if m[i] != "" {
+			var err error
+			n[i], err = strconv.Atoi(m[i])
+			if err != nil {
+				return "", 0, false
+			}
+		}
+	}
+	major, minor, patch, bundle, commits := n[1], n[2], n[3], n[4], n[5]
+	if major > 20 || minor > 99 || patch > 99 || bundle > 9 || commits > 999 {
+		return "", 0, false
+	}
+	version = m[1] + "." + m[2] + "." + m[3]
+	return version, major*100000000 + minor*1000000 + patch*10000 + bundle*1000 + commits, true
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParseDescribe(t *testing.T) {
+	tests := []struct {
+		describe string
+		version  string
+		code     int
+		ok       bool
+	}{
+		{"1.2.0", "1.2.0", 102000000, true},
+		{"1.2.0-14-g3a4b5c6", "1.2.0", 102000014, true},
+		{"1.2.0-3", "1.2.0", 102003000, true},
+		{"1.2.0-3-14-g3a4b5c6", "1.2.0", 102003014, true},
+		{"0.0.1", "0.0.1", 10000, true},
+		{"20.99.99-9-999-gabc", "20.99.99", 2099999999, true},
+		{"21.0.0", "", 0, false},
+		{"1.100.0", "", 0, false},
+		{"1.0.100", "", 0, false},
+		{"1.0.0-10", "", 0, false},
+		{"1.0.0-1000-gabc", "", 0, false},
+		{"99999999999999999999.0.0", "", 0, false},
+		{"v1.2.0", "", 0, false},
+		{"1.2", "", 0, false},
+		{"3a4b5c6", "", 0, false},
+		{"1.2.0-rc1", "", 0, false},
+	}
+	for _, tt := range tests {
+		version, code, ok := parseDescribe(tt.describe)
+		if version != tt.version || code != tt.code || ok != tt.ok {
+			t.Errorf("parseDescribe(%q) = %q, %d, %v, want %q, %d, %v", tt.describe, version, code, ok, tt.version, tt.code, tt.ok)
+		}
+	}
+}
+
+// Version codes must grow along with the history: with commits after a tag,
+// with bundles of a version and with versions.
+func TestVersionCodesOrdered(t *testing.T) {
+	history := []string{
+		"0.9.9-999-gabc",
+		"1.2.0",
+		"1.2.0-14-gabc",
+		"1.2.0-3",
+		"1.2.0-3-14-gabc",
+		"1.2.0-4",
+		"1.2.1",
+		"1.3.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	prev := -1
+	for _, d := range history {
+		_, code, ok := parseDescribe(d)
+		if !ok {
+			t.Fatalf("%s not parsed", d)
+		}
+		if code <= prev {
+			t.Errorf("the code of %s (%d) is not above the previous one (%d)", d, code, prev)
+		}
+		prev = code
+	}
+}
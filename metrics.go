@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+var (
+	buildsTotal = newCounter("butler_builds_total",
+		"Finished builds by project and status.", "project", "status")
+	buildDuration = newHistogram("butler_build_duration_seconds",
+		"Time taken by a builder to build one variant.",
+		[]float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600}, "builder")
+	fetchFailures = newCounter("butler_git_fetch_failures_total",
+		"Failed fetches of project sources.", "project")
+	httpRequests = newCounter("butler_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogram("butler_http_request_duration_seconds",
+		"Time taken to respond to HTTP requests.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "route")
+	diskBytes = newGauge("butler_builds_disk_bytes",
+		"Size of the builds kept on the local disk, as of the project's last update.", "project")
+)
+
+// metricsPage responds with the metrics in the Prometheus text format.
+func metricsPage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buildsTotal.write(w)
+	buildDuration.write(w)
+	fetchFailures.write(w)
+	httpRequests.write(w)
+	httpDuration.write(w)
+
+	writeHeader(w, "butler_queue_depth", "Build requests waiting in the queue.", "gauge")
+	fmt.Fprintf(w, "butler_queue_depth %d\n", queue.len())
+
+	writeHeader(w, "butler_running_builds", "Builds in progress.", "gauge")
+	fmt.Fprintf(w, "butler_running_builds %d\n", len(running.list()))
+
+	writeHeader(w, "butler_seconds_since_last_poll", "Time since the last successful update of a project.", "gauge")
+	for _, p := range updates.list() {
+		if p.LastPoll.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "butler_seconds_since_last_poll{%s} %g\n", labels([]string{"project"}, []string{p.Project}), time.Since(p.LastPoll).Seconds())
+	}
+
+	diskBytes.write(w)
+}
+
+// measureDiskUsage updates the disk usage metric of the project. Walking
+// the builds takes a while, so it's done on updates and not on scrapes.
+func measureDiskUsage(project string) {
+	size, err := storage.DiskUsage(project)
+	if err != nil {
+		return
+	}
+	diskBytes.set(float64(size), project)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels formats label pairs for the text format.
+func labels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = name + `="` + v + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// counter is a metric that only grows, with a separate value
+// for every combination of label values.
+type counter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// inc adds one to the counter with the given label values.
+func (c *counter) inc(values ...string) {
+	key := labels(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key]++
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, key, c.values[key])
+	}
+}
+
+// gauge is a metric that is set to the current value of something,
+// with a separate value for every combination of label values.
+type gauge struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newGauge(name, help string, labels ...string) *gauge {
+	return &gauge{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// set sets the gauge with the given label values.
+func (g *gauge) set(v float64, values ...string) {
+	key := labels(g.labels, values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s{%s} %g\n", g.name, key, g.values[key])
+	}
+}
+
+// histogram counts observed values in buckets, with a separate set
+// of buckets for every combination of label values.
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// observe records a value for the given label values.
+func (h *histogram) observe(v float64, values ...string) {
+	key := labels(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, b := range h.buckets {
+			le := strconv.FormatFloat(b, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, le, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, key, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusRecorder remembers the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The size of builds is measured on updates, not on every scrape.
+func TestDiskUsageMetric(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{"projects/app/builds/master/1.0.0/app.apk": "12345"})
+	measureDiskUsage("app")
+	writeFiles(t, map[string]string{"projects/app/builds/master/1.0.1/app.apk": "12345"})
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	if m := scrape(); !strings.Contains(m, `butler_builds_disk_bytes{project="app"} 5`+"\n") {
+		t.Errorf("no size from the last update in:\n%s", m)
+	}
+	measureDiskUsage("app")
+	if m := scrape(); !strings.Contains(m, `butler_builds_disk_bytes{project="app"} 10`+"\n") {
+		t.Errorf("no new size in:\n%s", m)
+	}
+}
+
+// A project directory can't take over a page's address.
+func TestReservedProjectNames(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{"projects/metrics/builds/master/1.0.0/app.apk": "apk"})
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/master/1.0.0/app.apk", nil))
+	if w.Code != 404 {
+		t.Errorf("got %d for a project named metrics", w.Code)
+	}
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(w.Body.String(), `href="/metrics"`) {
+		t.Error("the dashboard lists a project named metrics")
+	}
+}
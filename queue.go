@@ -0,0 +1,61 @@
+package main
+
+import "sync"
+
+// buildRequest is a request to build a ref outside of the regular updates.
+type buildRequest struct {
+	project string
+	ref     ref
+
+	// env has variables that override everything else in the build's environment.
+	env []string
+
+	// requested is true for builds requested through the API. They are
+	// saved apart from the regular builds of the same version.
+	requested bool
+
+	// upstream is the upstream build that triggered this one, if any.
+	upstream *upstreamBuild
+
+	// chain lists the projects whose builds led to this request.
+	chain []string
+}
+
+// buildQueue holds build requests until the update loop gets to their projects.
+type buildQueue struct {
+	mu    sync.Mutex
+	items []buildRequest
+}
+
+var queue = &buildQueue{}
+
+// push adds a request to the queue.
+func (q *buildQueue) push(r buildRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, r)
+}
+
+// take removes and returns all queued requests for the given project.
+func (q *buildQueue) take(project string) []buildRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	taken := make([]buildRequest, 0)
+	rest := make([]buildRequest, 0)
+	for _, r := range q.items {
+		if r.project == project {
+			taken = append(taken, r)
+		} else {
+			rest = append(rest, r)
+		}
+	}
+	q.items = rest
+	return taken
+}
+
+// len returns the number of queued requests.
+func (q *buildQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// params has the values of a matched route's path parameters.
+type params map[string]string
+
+// route maps requests with the given method and path pattern to a handler.
+// The pattern is a list of path segments, where a segment starting with ":"
+// matches any name and one starting with "#" matches only a number.
+type route struct {
+	name    string
+	method  string
+	pattern []string
+	handler func(w http.ResponseWriter, r *http.Request, p params)
+}
+
+// router dispatches requests to the first route matching the path.
+type router struct {
+	routes []route
+}
+
+func (rt *router) handle(name, method, pattern string, h func(w http.ResponseWriter, r *http.Request, p params)) {
+	rt.routes = append(rt.routes, route{
+		name:    name,
+		method:  method,
+		pattern: splitPath(pattern),
+		handler: h,
+	})
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: 200}
+	name := rt.serve(rec, r)
+	httpRequests.inc(name, r.Method, strconv.Itoa(rec.status))
+	httpDuration.observe(time.Since(started).Seconds(), name)
+}
+
+// serve dispatches the request and returns the name of the route that
+// handled it, or "none" if there was no such route.
+func (rt *router) serve(w http.ResponseWriter, r *http.Request) string {
+	segments, ok := decodePath(r.URL.EscapedPath())
+	if !ok {
+		rt.fail(w, r, 400, "Invalid URL")
+		return "none"
+	}
+
+	// Paths starting with a fixed name, like /api or /metrics, belong
+	// to the routes with that name even if they happen to look like
+	// project pages, so that, for example, API clients always get JSON.
+	first := ""
+	if len(segments) > 0 && rt.reserved(segments[0]) {
+		first = segments[0]
+	}
+
+	allowed := make([]string, 0)
+	for _, route := range rt.routes {
+		if route.prefix() != first {
+			continue
+		}
+		p, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method && !(route.method == "GET" && r.Method == "HEAD") {
+			if !contains(allowed, route.method) {
+				allowed = append(allowed, route.method)
+			}
+			continue
+		}
+		route.handler(w, r, p)
+		return route.name
+	}
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		rt.fail(w, r, 405, "Method not allowed")
+		return "none"
+	}
+	rt.fail(w, r, 404, "Not found")
+	return "none"
+}
+
+// fail responds with an error in the format the client expects:
+// JSON for the API and plain text for the rest.
+func (rt *router) fail(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/") {
+		apiError(w, status, strings.ToLower(message))
+		return
+	}
+	statusPage(w, status, message)
+}
+
+// prefix returns the fixed first segment of the route's pattern,
+// or an empty string if it's a parameter or there are no segments.
+func (route route) prefix() string {
+	if len(route.pattern) == 0 {
+		return ""
+	}
+	s := route.pattern[0]
+	if s[0] == ':' || s[0] == '#' {
+		return ""
+	}
+	return s
+}
+
+// prefixes returns the fixed first segments of the routes.
+// They can't be project names.
+func (rt *router) prefixes() []string {
+	list := make([]string, 0)
+	for _, route := range rt.routes {
+		if p := route.prefix(); p != "" && !contains(list, p) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// reserved returns true if the name is the fixed first segment of a route.
+func (rt *router) reserved(name string) bool {
+	return contains(rt.prefixes(), name)
+}
+
+func (route route) match(segments []string) (params, bool) {
+	if len(segments) != len(route.pattern) {
+		return nil, false
+	}
+	p := make(params)
+	for i, s := range route.pattern {
+		switch s[0] {
+		case ':':
+			p[s[1:]] = segments[i]
+		case '#':
+			if !isNumber(segments[i]) {
+				return nil, false
+			}
+			p[s[1:]] = segments[i]
+		default:
+			if s != segments[i] {
+				return nil, false
+			}
+		}
+	}
+	return p, true
+}
+
+// url returns the path of the route with the parameters filled in
+// in the order they appear in the pattern.
+func (route route) url(args ...string) string {
+	b := strings.Builder{}
+	for _, s := range route.pattern {
+		b.WriteString("/")
+		if s[0] == ':' || s[0] == '#' {
+			b.WriteString(url.PathEscape(args[0]))
+			args = args[1:]
+			continue
+		}
+		b.WriteString(s)
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// decodePath splits an escaped URL path into decoded segments.
+// A trailing slash is ignored. Segments that could escape the
+// data directories are rejected.
+func decodePath(escaped string) ([]string, bool) {
+	parts := splitPath(escaped)
+	for i, p := range parts {
+		s, err := url.PathUnescape(p)
+		if err != nil || !isValidName(s) {
+			return nil, false
+		}
+		parts[i] = s
+	}
+	return parts, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// urlFor returns the path of the named route with the given parameters.
+func urlFor(name string, args ...string) string {
+	for _, route := range routes.routes {
+		if route.name == name {
+			return route.url(args...)
+		}
+	}
+	panic("unknown route " + name)
+}
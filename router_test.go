@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRouter() (*router, *[]string) {
+	var calls []string
+	rt := &router{}
+	add := func(name, method, pattern string) {
+		rt.handle(name, method, pattern, func(w http.ResponseWriter, r *http.Request, p params) {
+			s := name
+			for _, k := range []string{"project", "branch", "number"} {
+				if v, ok := p[k]; ok {
+					s += " " + k + "=" + v
+				}
+			}
+			calls = append(calls, s)
+		})
+	}
+	add("root", "GET", "/")
+	add("api-list", "GET", "/api/projects/:project/builds")
+	add("api-request", "POST", "/api/projects/:project/builds")
+	add("build", "GET", "/:project/builds/#number")
+	add("project", "GET", "/:project")
+	add("branch", "GET", "/:project/:branch")
+	add("metrics", "GET", "/metrics")
+	return rt, &calls
+}
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		method, path string
+		status       int
+		call         string
+	}{
+		{"GET", "/", 200, "root"},
+		{"HEAD", "/", 200, "root"},
+		{"GET", "/app", 200, "project project=app"},
+		{"GET", "/app/", 200, "project project=app"},
+		{"GET", "/app/master", 200, "branch project=app branch=master"},
+		{"GET", "/app/feature%2Flogin", 200, "branch project=app branch=feature/login"},
+		{"GET", "/app/%D0%B2%D0%B5%D1%82%D0%BA%D0%B0", 200, "branch project=app branch=ветка"},
+		{"GET", "/app/builds/12", 200, "build project=app number=12"},
+		// Not a number, so it's a branch called "builds" and something else.
+		{"GET", "/app/builds/x", 404, ""},
+		{"GET", "/app/builds", 200, "branch project=app branch=builds"},
+		{"GET", "/api/projects/app/builds", 200, "api-list project=app"},
+		{"POST", "/api/projects/app/builds", 200, "api-request project=app"},
+		{"DELETE", "/api/projects/app/builds", 405, ""},
+		{"POST", "/app", 405, ""},
+		{"GET", "/a/b/c/d/e", 404, ""},
+		// Fixed names can't be projects.
+		{"GET", "/metrics", 200, "metrics"},
+		{"GET", "/metrics/master", 404, ""},
+		{"GET", "/api/master", 404, ""},
+		// Names that could escape the data directories.
+		{"GET", "/app/..%2F..%2Fetc", 400, ""},
+		{"GET", "/app/.git", 400, ""},
+		{"GET", "/app/x%2F%2Fy", 400, ""},
+		{"GET", "/app/a%00b", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rt, calls := testRouter()
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			want := []string{}
+			if tt.call != "" {
+				want = []string{tt.call}
+			}
+			if len(*calls) != len(want) || (len(want) > 0 && (*calls)[0] != want[0]) {
+				t.Errorf("called %q, want %q", *calls, want)
+			}
+		})
+	}
+}
+
+// API paths never fall through to pages, and their errors are JSON.
+func TestRouterAPIErrors(t *testing.T) {
+	rt, calls := testRouter()
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/api/nothing", 404},
+		{"GET", "/api", 404},
+		{"PUT", "/api/projects/app/builds", 405},
+	} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: not JSON: %s", tt.method, tt.path, w.Body)
+		}
+	}
+	if len(*calls) != 0 {
+		t.Errorf("called %q", *calls)
+	}
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/projects/app/builds", nil))
+	if allow := w.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Allow: %q", allow)
+	}
+}
+
+func TestRouteURL(t *testing.T) {
+	rt, _ := testRouter()
+	for _, name := range []string{"feature/login", "a b?c#d", "<x>", "ветка", "50%"} {
+		r := rt.routes[5]
+		u := r.url("app", name)
+		if strings.Count(u, "/") != 2 {
+			t.Errorf("%q gave %s", name, u)
+		}
+		segments, ok := decodePath(u)
+		if !ok || !reflect.DeepEqual(segments, []string{"app", name}) {
+			t.Errorf("%q gave %s, which decodes to %q", name, u, segments)
+		}
+	}
+	if _, ok := decodePath("/app/%zz"); ok {
+		t.Error("a malformed escape was decoded")
+	}
+	if u := rt.routes[0].url(); u != "/" {
+		t.Errorf("root url is %q", u)
+	}
+	if u := rt.routes[3].url("app", "12"); u != "/app/builds/12" {
+		t.Errorf("build url is %q", u)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// runningBuild is a build in progress.
+type runningBuild struct {
+	Project string
+	Ref     ref
+	Version string
+	Number  int
+	Started time.Time
+}
+
+func (b runningBuild) key() string {
+	return b.Project + "#" + strconv.Itoa(b.Number)
+}
+
+// LogURL returns the address of the build's log.
+func (b runningBuild) LogURL() string {
+	return urlFor("file", b.Project, b.Ref.directory(), b.Version, storage.LogName)
+}
+
+// runningBuilds keeps track of builds in progress.
+type runningBuilds struct {
+	mu     sync.Mutex
+	builds map[string]runningBuild
+}
+
+var running = &runningBuilds{
+	builds: make(map[string]runningBuild),
+}
+
+// start records that a build has started.
+func (rb *runningBuilds) start(b runningBuild) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.builds[b.key()] = b
+}
+
+// finish records that a build has finished.
+func (rb *runningBuilds) finish(b runningBuild) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	delete(rb.builds, b.key())
+}
+
+// has returns true if the given version is being built.
+func (rb *runningBuilds) has(project, directory, version string) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for _, b := range rb.builds {
+		if b.Project == project && b.Ref.directory() == directory && b.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the builds in progress, oldest first.
+func (rb *runningBuilds) list() []runningBuild {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	list := make([]runningBuild, 0, len(rb.builds))
+	for _, b := range rb.builds {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
@@ -1,113 +1,340 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/gaswelder/butler/storage"
 )
 
-// serveBuilds spawns an HTTP server that serves all builds for all projects.
+// routes has all pages and API endpoints.
+var routes = &router{}
+
+func init() {
+	routes.handle("dashboard", "GET", "/", func(w http.ResponseWriter, r *http.Request, p params) {
+		rootPage(w)
+	})
+	routes.handle("signing-key", "GET", "/api/signing-key", func(w http.ResponseWriter, r *http.Request, p params) {
+		signingKey(w)
+	})
+	routes.handle("api-builds", "GET", "/api/projects/:project/builds", func(w http.ResponseWriter, r *http.Request, p params) {
+		listBuilds(w, p["project"])
+	})
+	routes.handle("api-request-build", "POST", "/api/projects/:project/builds", withToken(func(w http.ResponseWriter, r *http.Request, p params) {
+		requestBuild(w, r, p["project"])
+	}))
+	routes.handle("api-build", "GET", "/api/projects/:project/builds/#number", func(w http.ResponseWriter, r *http.Request, p params) {
+		n, _ := strconv.Atoi(p["number"])
+		showBuild(w, p["project"], n)
+	})
+	routes.handle("metrics", "GET", "/metrics", func(w http.ResponseWriter, r *http.Request, p params) {
+		metricsPage(w)
+	})
+	routes.handle("healthz", "GET", "/healthz", func(w http.ResponseWriter, r *http.Request, p params) {
+		healthz(w)
+	})
+	routes.handle("readyz", "GET", "/readyz", func(w http.ResponseWriter, r *http.Request, p params) {
+		readyz(w)
+	})
+	routes.handle("diagnostics", "GET", "/diagnostics", func(w http.ResponseWriter, r *http.Request, p params) {
+		diagnostics(w)
+	})
+	routes.handle("project", "GET", "/:project", func(w http.ResponseWriter, r *http.Request, p params) {
+		before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+		projectIndex(w, p["project"], before)
+	})
+	routes.handle("build", "GET", "/:project/builds/#number", func(w http.ResponseWriter, r *http.Request, p params) {
+		n, _ := strconv.Atoi(p["number"])
+		buildByNumber(w, r, p["project"], n)
+	})
+	routes.handle("branch", "GET", "/:project/:branch", func(w http.ResponseWriter, r *http.Request, p params) {
+		branchIndex(w, r, p["project"], p["branch"])
+	})
+	routes.handle("latest", "GET", "/:project/:branch/latest", func(w http.ResponseWriter, r *http.Request, p params) {
+		latest(w, r, p["project"], p["branch"], "")
+	})
+	routes.handle("latest-file", "GET", "/:project/:branch/latest/:pattern", func(w http.ResponseWriter, r *http.Request, p params) {
+		latest(w, r, p["project"], p["branch"], p["pattern"])
+	})
+	routes.handle("version", "GET", "/:project/:branch/:version", func(w http.ResponseWriter, r *http.Request, p params) {
+		versionIndex(w, r, p["project"], p["branch"], p["version"])
+	})
+	routes.handle("file", "GET", "/:project/:branch/:version/:file", func(w http.ResponseWriter, r *http.Request, p params) {
+		serveBuild(w, r, p["project"], p["branch"], p["version"], p["file"])
+	})
+	storage.ReserveNames(routes.prefixes()...)
+}
+
+// httpServer serves all builds for all projects.
+var httpServer = &http.Server{Addr: ":8080", Handler: routes}
+
+// serveBuilds runs the HTTP server until it's shut down.
 func serveBuilds() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		parts := strings.Split(r.RequestURI, "/")
-		if parts[0] == "" {
-			parts = parts[1:]
-		}
-		if len(parts) > 0 && parts[len(parts)-1] == "" {
-			parts = parts[:len(parts)-1]
-		}
-		for _, p := range parts {
-			if !isValidName(p) {
-				statusPage(w, 400, "Invalid URL")
-				return
-			}
-		}
+	err := httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		slog.Error("HTTP server failed", "err", err)
+	}
+}
 
-		n := len(parts)
-		if n == 0 {
-			rootPage(w)
-			return
-		}
-		if n == 1 {
-			projectIndex(w, parts[0])
-			return
+type versionEntry struct {
+	Name string
+	Info *storage.BuildInfo
+}
+
+type branchPage struct {
+	Project  string
+	Branch   string
+	Versions []versionEntry
+}
+
+func branchIndex(w http.ResponseWriter, r *http.Request, projectName, branch string) {
+	versions, err := storage.Versions(projectName, branch)
+	if os.IsNotExist(err) {
+		notFound(w, r, projectName, branch, func(b string) string {
+			return urlFor("branch", projectName, b)
+		})
+		return
+	}
+	if err != nil {
+		statusPage(w, 500, "Failed to get versions list: "+err.Error())
+		return
+	}
+	page := branchPage{
+		Project:  projectName,
+		Branch:   branch,
+		Versions: make([]versionEntry, len(versions)),
+	}
+	for i, v := range versions {
+		page.Versions[i].Name = v
+		info, err := storage.Info(projectName, branch, v)
+		if err == nil {
+			page.Versions[i].Info = info
 		}
-		if n == 2 {
-			branchIndex(w, parts[0], parts[1])
-			return
+	}
+	render(w, "branch", page)
+}
+
+type versionPage struct {
+	Project string
+	Branch  string
+	Version string
+	Info    *storage.BuildInfo
+	Matrix  buildMatrix
+	Files   []string
+}
+
+func versionIndex(w http.ResponseWriter, r *http.Request, projectName, branch, version string) {
+	builds, err := storage.Builds(projectName, branch, version)
+	if os.IsNotExist(err) {
+		notFound(w, r, projectName, branch, func(b string) string {
+			return urlFor("version", projectName, b, version)
+		})
+		return
+	}
+	if err != nil {
+		statusPage(w, 500, "Failed to get builds list: "+err.Error())
+		return
+	}
+	info, err := storage.Info(projectName, branch, version)
+	if err != nil && !os.IsNotExist(err) {
+		statusPage(w, 500, "Failed to get build info: "+err.Error())
+		return
+	}
+	page := versionPage{
+		Project: projectName,
+		Branch:  branch,
+		Version: version,
+		Info:    info,
+		Files:   builds,
+	}
+	if info != nil {
+		page.Matrix = matrix(info)
+	}
+	render(w, "version", page)
+}
+
+// buildMatrix is a table of build cells with builders as rows
+// and variants as columns.
+type buildMatrix struct {
+	Variants []string
+	Rows     []matrixRow
+}
+
+type matrixRow struct {
+	Name string
+	// Cells has a cell for every variant, nil if there's none.
+	Cells []*storage.Cell
+}
+
+func matrix(info *storage.BuildInfo) buildMatrix {
+	builders := make([]string, 0)
+	variants := make([]string, 0)
+	cells := make(map[string]storage.Cell)
+	for _, c := range info.Cells {
+		row := c.Builder + " (" + c.Dir + ")"
+		if !contains(builders, row) {
+			builders = append(builders, row)
 		}
-		if n == 3 {
-			versionIndex(w, parts[0], parts[1], parts[2])
-			return
+		if !contains(variants, c.Variant) {
+			variants = append(variants, c.Variant)
 		}
-		if n == 4 {
-			serveBuild(w, parts[0], parts[1], parts[2], parts[3])
-			return
+		cells[row+"/"+c.Variant] = c
+	}
+
+	m := buildMatrix{Variants: variants}
+	for _, name := range builders {
+		row := matrixRow{Name: name, Cells: make([]*storage.Cell, len(variants))}
+		for i, v := range variants {
+			if c, ok := cells[name+"/"+v]; ok {
+				row.Cells[i] = &c
+			}
 		}
-		statusPage(w, 404, "Not found")
-	})
-	http.ListenAndServe(":8080", nil)
+		m.Rows = append(m.Rows, row)
+	}
+	return m
 }
 
-func rootPage(w http.ResponseWriter) {
-	statusPage(w, 200, "Nothing here")
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
-func projectIndex(w http.ResponseWriter, projectName string) {
-	branches, err := storage.Branches(projectName)
+// buildByNumber redirects to the page of the build with the given number.
+func buildByNumber(w http.ResponseWriter, r *http.Request, projectName string, number int) {
+	b, err := storage.BuildByNumber(projectName, number)
+	if os.IsNotExist(err) {
+		statusPage(w, 404, "Not found")
+		return
+	}
 	if err != nil {
 		statusPage(w, 500, err.Error())
 		return
 	}
+	u := urlFor("version", projectName, b.Branch, b.Version)
+	http.Redirect(w, r, u, http.StatusFound)
+}
 
-	w.Header().Add("Content-Type", "text/html;charset=utf-8")
-	fmt.Fprintf(w, "<h1>%s</h1>", projectName)
-	fmt.Fprint(w, breadcrumbs(projectName))
-	fmt.Fprint(w, "<ol>")
-	for _, branch := range branches {
-		fmt.Fprintf(w, "<li><a href=\"/%s/%s/\">%s</a></li>", projectName, branch, branch)
+// notFound answers requests for missing builds. Addresses with a branch
+// name made by the old lossy conversion are redirected to the address
+// made by the given function for the branch the builds were moved to.
+func notFound(w http.ResponseWriter, r *http.Request, project, branch string, to func(branch string) string) {
+	if b, ok := storage.LegacyBranch(project, branch); ok {
+		http.Redirect(w, r, to(b), http.StatusFound)
+		return
 	}
-	fmt.Fprint(w, "</ol>")
+	statusPage(w, 404, "Not found")
 }
 
-func branchIndex(w http.ResponseWriter, projectName, branch string) {
-	versions, err := storage.Versions(projectName, branch)
+// latest redirects to the newest successful build of the branch or,
+// if the pattern is given, to the first of its files matching the pattern.
+func latest(w http.ResponseWriter, r *http.Request, projectName, branch, pattern string) {
+	version, err := storage.Latest(projectName, branch)
+	if os.IsNotExist(err) {
+		if to, ok := storage.LegacyBranch(projectName, branch); ok {
+			u := urlFor("latest", projectName, to)
+			if pattern != "" {
+				u = urlFor("latest-file", projectName, to, pattern)
+			}
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+		statusPage(w, 404, "No successful builds")
+		return
+	}
 	if err != nil {
-		statusPage(w, 500, "Failed to get versions list: "+err.Error())
+		statusPage(w, 500, err.Error())
 		return
 	}
-	w.Header().Add("Content-Type", "text/html;charset=utf-8")
-	fmt.Fprintf(w, "<h1>%s</h1>", projectName)
-	fmt.Fprint(w, breadcrumbs(projectName, branch))
-	fmt.Fprint(w, "<ol>")
-	for _, v := range versions {
-		fmt.Fprintf(w, "<li><a href=\"/%s/%s/%s\">%s</a></li>", projectName, branch, v, v)
+	u := urlFor("version", projectName, branch, version)
+	if pattern == "" {
+		http.Redirect(w, r, u, http.StatusFound)
+		return
 	}
-	fmt.Fprint(w, "</ol>")
-}
 
-func versionIndex(w http.ResponseWriter, projectName, branch, version string) {
-	builds, err := storage.Builds(projectName, branch, version)
+	files, err := storage.Builds(projectName, branch, version)
 	if err != nil {
-		statusPage(w, 500, "Failed to get builds list: "+err.Error())
+		statusPage(w, 500, err.Error())
 		return
 	}
-	w.Header().Add("Content-Type", "text/html;charset=utf-8")
-	fmt.Fprintf(w, "<h1>%s</h1>", projectName)
-	fmt.Fprint(w, breadcrumbs(projectName, branch, version))
-	fmt.Fprint(w, "<ol>")
-	for _, b := range builds {
-		fmt.Fprintf(w, "<li><a href=\"/%s/%s/%s/%s\">%s</a></li>", projectName, branch, version, b, b)
+	for _, f := range files {
+		ok, err := path.Match(pattern, f)
+		if err != nil {
+			statusPage(w, 400, "Invalid pattern: "+err.Error())
+			return
+		}
+		if ok {
+			http.Redirect(w, r, urlFor("file", projectName, branch, version, f), http.StatusFound)
+			return
+		}
 	}
-	fmt.Fprint(w, "</ol>")
+	statusPage(w, 404, "No files matching "+pattern+" in "+version)
 }
 
-func serveBuild(w http.ResponseWriter, project, branch, version, file string) {
+func serveBuild(w http.ResponseWriter, r *http.Request, project, branch, version, file string) {
+	if storage.Hidden(file) {
+		statusPage(w, 404, "Not found")
+		return
+	}
+	if file == storage.LogName && running.has(project, branch, version) {
+		serveLiveLog(w, r, project, branch, version)
+		return
+	}
 	f, err := storage.Build(project, branch, version, file)
+	if os.IsNotExist(err) {
+		notFound(w, r, project, branch, func(b string) string {
+			return urlFor("file", project, b, version, file)
+		})
+		return
+	}
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+	defer f.Close()
+	entry, err := storage.Verify(project, branch, version, file)
+	if errors.Is(err, storage.ErrIntegrity) {
+		slog.Error("damaged build file", "project", project, "branch", branch, "version", version, "file", file, "err", err)
+		statusPage(w, 500, "The file is damaged: "+err.Error())
+		return
+	}
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+	st, err := f.Stat()
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType(file))
+	if isDownload(file) {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file}))
+	}
+	// A version can be rebuilt, so clients have to check for changes.
+	h.Set("Cache-Control", "no-cache")
+	if entry != nil {
+		h.Set("ETag", `"`+entry.SHA256+`"`)
+	}
+	// ServeContent takes care of ranges and conditional requests.
+	http.ServeContent(w, r, file, st.ModTime(), f)
+}
+
+// serveLiveLog serves the log of a build in progress.
+func serveLiveLog(w http.ResponseWriter, r *http.Request, project, branch, version string) {
+	f, err := storage.LiveLog(project, branch, version)
 	if os.IsNotExist(err) {
 		statusPage(w, 404, "Not found")
 		return
@@ -117,37 +344,64 @@ func serveBuild(w http.ResponseWriter, project, branch, version, file string) {
 		return
 	}
 	defer f.Close()
-	if strings.HasSuffix(file, ".log") {
-		w.Header().Add("Content-Type", "text/plain;charset=utf-8")
+	st, err := f.Stat()
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType(storage.LogName))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, storage.LogName, st.ModTime(), f)
+}
+
+// contentTypes has types for the files that mime.TypeByExtension might not know.
+var contentTypes = map[string]string{
+	".apk":   "application/vnd.android.package-archive",
+	".aab":   "application/octet-stream",
+	".ipa":   "application/octet-stream",
+	".plist": "application/xml",
+	".log":   "text/plain;charset=utf-8",
+	".json":  "application/json",
+	".sig":   "text/plain;charset=utf-8",
+}
+
+func contentType(file string) string {
+	ext := strings.ToLower(path.Ext(file))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
 	}
-	io.Copy(w, f)
+	return "application/octet-stream"
+}
+
+// isDownload returns true for files that should be saved rather than
+// shown in the browser.
+func isDownload(file string) bool {
+	switch strings.ToLower(path.Ext(file)) {
+	case ".log", ".json", ".sig", ".txt":
+		return false
+	}
+	return true
 }
 
 func statusPage(w http.ResponseWriter, status int, message string) {
+	// Messages can contain names from URLs, so they are never sent as HTML.
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(status)
 	fmt.Fprint(w, message)
 }
 
+// isValidName returns true if the name from a URL is safe to use
+// in file paths. Names may contain slashes, like branch names do,
+// but none of their parts may be empty or start with a dot.
 func isValidName(name string) bool {
-	for i, ch := range name {
-		if i == 0 && ch == '.' {
-			return false
-		}
-		if ch == '/' {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part[0] == '.' || strings.ContainsRune(part, 0) {
 			return false
 		}
 	}
 	return true
 }
-
-func breadcrumbs(parts ...string) string {
-	b := strings.Builder{}
-	b.WriteString("<nav>")
-	for i, v := range parts[:len(parts)-1] {
-		path := strings.Join(parts[:i+1], "/")
-		b.WriteString("<a href=\"/" + path + "\">" + v + "</a> / ")
-	}
-	b.WriteString(parts[len(parts)-1])
-	b.WriteString("</nav>")
-	return b.String()
-}
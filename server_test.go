@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+func TestLiveLog(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/app/builds/master/1.0.0/build.log":  "old log",
+		"projects/app/staging/master/1.0.0/build.log": "live log",
+	})
+	get := func() string {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", "/app/master/1.0.0/build.log", nil))
+		if w.Code != 200 {
+			t.Fatalf("status %d", w.Code)
+		}
+		return w.Body.String()
+	}
+	if got := get(); got != "old log" {
+		t.Errorf("got %q before the build started, want the saved log", got)
+	}
+	b := runningBuild{Project: "app", Ref: ref{name: "master"}, Version: "1.0.0", Number: 7}
+	running.start(b)
+	if got := get(); got != "live log" {
+		t.Errorf("got %q while building, want the live log", got)
+	}
+	running.finish(b)
+	if got := get(); got != "old log" {
+		t.Errorf("got %q after the build, want the saved log", got)
+	}
+}
+
+func TestBuildInfoNotServed(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/app/builds/master/1.0.0/build.json": `{"number": 1}`,
+	})
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/app/master/1.0.0/build.json", nil))
+	if w.Code != 404 {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+}
+
+// Addresses from before branches were stored under reversible keys
+// lead to where the builds were moved.
+func TestLegacyBranchRedirect(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"projects/app/builds/fix_2fcrash/1.0.0/app.apk": "apk",
+	})
+	for path, want := range map[string]string{
+		"/app/fix-crash":                     "/app/fix%2Fcrash",
+		"/app/fix-crash/1.0.0":               "/app/fix%2Fcrash/1.0.0",
+		"/app/fix-crash/1.0.0/app.apk":       "/app/fix%2Fcrash/1.0.0/app.apk",
+		"/app/fix-crash/latest":              "/app/fix%2Fcrash/latest",
+		"/app/fix-crash/latest/" + "%2A.apk": "/app/fix%2Fcrash/latest/%2A.apk",
+	} {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 302 || w.Header().Get("Location") != want {
+			t.Errorf("GET %s: %d to %q, want a redirect to %s", path, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/app/other-branch", nil))
+	if w.Code != 404 {
+		t.Errorf("got %d for a missing branch", w.Code)
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{"projects/app/.env": ""})
+	commitBuild(t, "app", "master", "1.0.0", "first")
+	sum := sha256.Sum256([]byte("apk"))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	tests := []struct {
+		method  string
+		file    string
+		header  map[string]string
+		status  int
+		body    string
+		headers map[string]string
+	}{
+		{"GET", "app.apk", nil, 200, "apk", map[string]string{
+			"Content-Type":        "application/vnd.android.package-archive",
+			"Content-Disposition": `attachment; filename=app.apk`,
+			"Content-Length":      "3",
+			"Accept-Ranges":       "bytes",
+			"Cache-Control":       "no-cache",
+			"ETag":                etag,
+		}},
+		{"HEAD", "app.apk", nil, 200, "", map[string]string{"Content-Length": "3", "ETag": etag}},
+		{"GET", "build.log", nil, 200, "", map[string]string{
+			"Content-Type":        "text/plain;charset=utf-8",
+			"Content-Disposition": "",
+			"ETag":                "",
+		}},
+
+		// Resumed downloads.
+		{"GET", "app.apk", map[string]string{"Range": "bytes=1-"}, 206, "pk", map[string]string{"Content-Range": "bytes 1-2/3"}},
+		{"GET", "app.apk", map[string]string{"Range": "bytes=-1"}, 206, "k", map[string]string{"Content-Range": "bytes 2-2/3"}},
+		{"GET", "app.apk", map[string]string{"Range": "bytes=3-"}, 416, "", nil},
+		{"GET", "app.apk", map[string]string{"Range": "bytes=1-", "If-Range": etag}, 206, "pk", nil},
+		// The file has changed since the download started.
+		{"GET", "app.apk", map[string]string{"Range": "bytes=1-", "If-Range": `"old"`}, 200, "apk", nil},
+
+		// Conditional requests.
+		{"GET", "app.apk", map[string]string{"If-None-Match": etag}, 304, "", map[string]string{"ETag": etag}},
+		{"GET", "app.apk", map[string]string{"If-None-Match": `"old", ` + etag}, 304, "", nil},
+		{"GET", "app.apk", map[string]string{"If-None-Match": `"old"`}, 200, "apk", nil},
+		{"GET", "app.apk", map[string]string{"If-Match": `"old"`}, 412, "", nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/app/master/1.0.0/"+tt.file, nil)
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s %v: status %d, want %d", tt.method, tt.file, tt.header, w.Code, tt.status)
+			continue
+		}
+		if tt.body != "" || w.Code == 304 || tt.method == "HEAD" {
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("%s %s %v: body %q, want %q", tt.method, tt.file, tt.header, got, tt.body)
+			}
+		}
+		for k, want := range tt.headers {
+			if got := w.Header().Get(k); got != want {
+				t.Errorf("%s %s %v: %s is %q, want %q", tt.method, tt.file, tt.header, k, got, want)
+			}
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		file     string
+		typ      string
+		download bool
+	}{
+		{"app.apk", "application/vnd.android.package-archive", true},
+		{"APP.APK", "application/vnd.android.package-archive", true},
+		{"app.aab", "application/octet-stream", true},
+		{"app.ipa", "application/octet-stream", true},
+		{"manifest.plist", "application/xml", true},
+		{"build.log", "text/plain;charset=utf-8", false},
+		{"manifest.json", "application/json", false},
+		{"manifest.json.sig", "text/plain;charset=utf-8", false},
+		{"notes.txt", "text/plain; charset=utf-8", false},
+		{"app.zip", "application/zip", true},
+		{"binary", "application/octet-stream", true},
+		{"app.unknownext", "application/octet-stream", true},
+	}
+	for _, tt := range tests {
+		if got := contentType(tt.file); got != tt.typ {
+			t.Errorf("contentType(%s) = %q, want %q", tt.file, got, tt.typ)
+		}
+		if got := isDownload(tt.file); got != tt.download {
+			t.Errorf("isDownload(%s) = %v, want %v", tt.file, got, tt.download)
+		}
+	}
+}
+
+func TestLatestRedirect(t *testing.T) {
+	inTempDir(t)
+	info := func(status, finished string, requested bool) string {
+		return fmt.Sprintf(`{"status": %q, "finished": %q, "requested": %v}`, status, finished, requested)
+	}
+	rel := storage.ReleasesDirectory
+	writeFiles(t, map[string]string{
+		"projects/app/builds/master/1.10.0/build.json":         info("ok", "2024-01-01T10:00:00Z", false),
+		"projects/app/builds/master/1.10.0/app.apk":            "apk",
+		"projects/app/builds/master/1.9.0/build.json":          info("ok", "2024-01-01T11:00:00Z", false),
+		"projects/app/builds/master/1.9.0/app.apk":             "apk",
+		"projects/app/builds/master/1.9.0/app.aab":             "aab",
+		"projects/app/builds/master/1.11.0/build.json":         info("failed", "2024-01-01T12:00:00Z", false),
+		"projects/app/builds/master/1.9.0-r1/build.json":       info("ok", "2024-01-01T13:00:00Z", true),
+		"projects/app/builds/" + rel + "/1.9.0/build.json":     info("ok", "2024-01-01T11:00:00Z", false),
+		"projects/app/builds/" + rel + "/1.10.0/build.json":    info("ok", "2024-01-01T10:00:00Z", false),
+		"projects/app/builds/" + rel + "/1.10.0-r1/build.json": info("ok", "2024-01-01T12:00:00Z", true),
+		"projects/app/builds/develop/2.0.0/build.json":         info("failed", "2024-01-01T10:00:00Z", false),
+	})
+	tests := []struct {
+		path   string
+		status int
+		to     string
+	}{
+		{urlFor("latest", "app", "master"), 302, urlFor("version", "app", "master", "1.9.0")},
+		{urlFor("latest-file", "app", "master", "*.aab"), 302, urlFor("file", "app", "master", "1.9.0", "app.aab")},
+		{urlFor("latest-file", "app", "master", "*.zip"), 404, ""},
+		{urlFor("latest-file", "app", "master", "["), 400, ""},
+		{urlFor("latest", "app", rel), 302, urlFor("version", "app", rel, "1.10.0")},
+		{urlFor("latest", "app", "develop"), 404, ""},
+		{urlFor("latest", "app", "missing"), 404, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status || w.Header().Get("Location") != tt.to {
+			t.Errorf("GET %s: %d to %q, want %d to %q", tt.path, w.Code, w.Header().Get("Location"), tt.status, tt.to)
+		}
+	}
+}
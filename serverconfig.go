@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// serverConfigPath is the path to the server's own settings file.
+const serverConfigPath = "server.json"
+
+type serverConfig struct {
+	// Env has default variables for all builds.
+	Env map[string]string `json:"env"`
+
+	// HostEnv selects what variables of the server's own environment
+	// are passed to builds.
+	HostEnv hostEnvFilter `json:"hostEnv"`
+
+	// APIToken is the token that clients must give to request builds.
+	// If it's empty, build requests are refused.
+	APIToken string `json:"apiToken"`
+
+	// S3, if given, makes the builds kept in an S3-compatible storage
+	// instead of the local disk.
+	S3 *storage.S3Config `json:"s3"`
+
+	// Log sets the level and format of the server's log.
+	Log logConfig `json:"log"`
+
+	// ShutdownTimeout is how many seconds running builds are given
+	// to finish when butler is stopped.
+	ShutdownTimeout int `json:"shutdownTimeout"`
+
+	// Git selects the git implementation: "cli" (the default)
+	// or "go-git".
+	Git string `json:"git"`
+}
+
+// hostEnvFilter has lists of variable name patterns. If Allow is given, only
+// variables matching it are passed, otherwise all are. Variables matching Deny
+// are never passed.
+type hostEnvFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// alwaysDenied are host variables that are never passed to builds.
+var alwaysDenied = []string{"BUTLER_MASTER_KEY"}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		ok, err := path.Match(p, name)
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the variables from the list that pass the filter.
+func (f hostEnvFilter) filter(vars []string) []string {
+	list := make([]string, 0)
+	for _, v := range vars {
+		name := strings.SplitN(v, "=", 2)[0]
+		if len(f.Allow) > 0 && !matchesAny(f.Allow, name) {
+			continue
+		}
+		if matchesAny(f.Deny, name) || matchesAny(alwaysDenied, name) {
+			continue
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+// loadServerConfig reads the server settings file.
+// If there is no such file, the default settings are returned.
+func loadServerConfig() (*serverConfig, error) {
+	cfg := &serverConfig{}
+	data, err := ioutil.ReadFile(serverConfigPath)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", serverConfigPath, err)
+	}
+	return cfg, nil
+}
+
+// setupStorage selects where the builds are kept according to the server settings.
+func setupStorage(cfg *serverConfig) {
+	if cfg.S3 == nil {
+		return
+	}
+	s3 := *cfg.S3
+	if s3.AccessKey == "" {
+		s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s3.SecretKey == "" {
+		s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	storage.SetBackend(storage.S3(s3))
+}
+
+// setupGit selects the git implementation according to the server settings.
+func setupGit(cfg *serverConfig) error {
+	switch cfg.Git {
+	case "", "cli":
+		gitBackend = "cli"
+	case "go-git":
+		gitBackend = "go-git"
+	default:
+		return fmt.Errorf("unknown git implementation: %s", cfg.Git)
+	}
+	return nil
+}
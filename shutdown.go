@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// stop is closed when butler is shutting down.
+var stop = make(chan struct{})
+
+// loopDone is closed when the update loop has exited.
+var loopDone = make(chan struct{})
+
+// buildCtx is canceled to kill the running builds.
+var buildCtx, killBuilds = context.WithCancel(context.Background())
+
+// defaultShutdownTimeout is how long running builds are waited for
+// on shutdown unless the server config says otherwise.
+const defaultShutdownTimeout = 5 * time.Minute
+
+// stopping returns true if butler is shutting down and
+// no new builds should be started.
+func stopping() bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// pause waits for the given time and returns false
+// if butler started shutting down in the meantime.
+func pause(d time.Duration) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// shutdown stops starting new builds and waits for the running ones to
+// finish. Builds still running after the timeout are killed and left in
+// the staging directory to be recovered on the next start.
+func shutdown(timeout time.Duration) {
+	slog.Info("shutting down", "running", len(running.list()), "timeout", timeout.String())
+	close(stop)
+	select {
+	case <-loopDone:
+	case <-time.After(timeout):
+		slog.Warn("killing running builds", "running", len(running.list()))
+		killBuilds()
+		select {
+		case <-loopDone:
+		case <-time.After(30 * time.Second):
+			slog.Error("the update loop didn't stop")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	httpServer.Shutdown(ctx)
+}
+
+// recoverBuilds saves builds interrupted by a crash or a kill as failed
+// and queues their branches or tags to be built again. Only the current
+// tip of a branch is built, so if the branch has moved on since, the
+// interrupted version stays failed. Requested builds are not made again,
+// since the variables they were requested with are not kept.
+func recoverBuilds() {
+	projects, err := storage.Projects()
+	if err != nil {
+		slog.Error("failed to get projects list", "err", err)
+		return
+	}
+	for _, p := range projects {
+		builds, err := storage.RecoverInterrupted(p.Name)
+		if err != nil {
+			slog.Error("failed to recover interrupted builds", "project", p.Name, "err", err)
+		}
+		for _, b := range builds {
+			l := slog.With("project", p.Name, "version", b.Version, "build", b.Number)
+			r, ok := parseRef(b.Origin.Ref)
+			if !ok {
+				l.Warn("not requeueing an interrupted build, its log doesn't say what was built")
+				continue
+			}
+			if b.Origin.Requested {
+				l.Warn("not requeueing an interrupted requested build, request it again", r.attr())
+				continue
+			}
+			l.Warn("requeueing the branch or tag of an interrupted build", r.attr())
+			queue.push(buildRequest{project: p.Name, ref: r})
+		}
+	}
+}
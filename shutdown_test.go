@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// Interrupted builds are requeued as what they were built of,
+// except the requested ones.
+func TestRecoverBuilds(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{"projects/app/project.json": `{}`})
+	defer queue.take("app")
+	builds := []struct {
+		r         ref
+		version   string
+		requested bool
+	}{
+		{ref{name: "feature/login"}, "1.0.0-2-gabcdef0", false},
+		{ref{name: "1.0.0", isTag: true}, "1.0.0", false},
+		{ref{name: "1.1.0", isTag: true}, "1.1.0-r1", true},
+		{ref{name: "master"}, "1.0.0-1-g1234567-r1", true},
+	}
+	for _, b := range builds {
+		log, err := storage.BuildLogger("app", b.r.directory(), b.version, storage.Origin{Ref: b.r.fullName(), Requested: b.requested}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.Close()
+	}
+
+	recoverBuilds()
+	got := make([]ref, 0)
+	for _, req := range queue.take("app") {
+		if req.requested || req.upstream != nil || len(req.env) > 0 {
+			t.Errorf("requeued as %+v", req)
+		}
+		got = append(got, req.ref)
+	}
+	want := []ref{{name: "feature/login"}, {name: "1.0.0", isTag: true}}
+	if len(got) != len(want) {
+		t.Fatalf("requeued %v, want %v", got, want)
+	}
+	for _, r := range want {
+		found := false
+		for _, g := range got {
+			found = found || reflect.DeepEqual(g, r)
+		}
+		if !found {
+			t.Errorf("%s is not requeued: %v", r, got)
+		}
+	}
+}
+
+func TestParseRef(t *testing.T) {
+	for _, r := range []ref{{name: "master"}, {name: "feature/login"}, {name: "1.0.0", isTag: true}} {
+		if got, ok := parseRef(r.fullName()); !ok || got != r {
+			t.Errorf("%s: got %v, %v", r.fullName(), got, ok)
+		}
+	}
+	for _, name := range []string{"", "master", "refs/heads/", "refs/tags/", "refs/remotes/origin/master"} {
+		if got, ok := parseRef(name); ok {
+			t.Errorf("%q is parsed as %v", name, got)
+		}
+	}
+}
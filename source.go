@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// gitBackend selects the git implementation: "cli" runs the git program,
+// "go-git" works without it.
+var gitBackend = "cli"
+
+// projectGit returns the git of the project's source directory,
+// with the output of commands going to the given log. Commands that
+// talk to the remote need the credentials from remoteGit.
+func projectGit(project storage.Project, log io.Writer) git {
+	sourceDir := storage.SourcePath(project.Name)
+	defaultBranch := ""
+	shallow := false
+	if project.Remote != nil {
+		defaultBranch = project.Remote.Branch
+		shallow = project.Remote.Depth > 0
+	}
+	if gitBackend == "go-git" {
+		return goGit{sourceDir: sourceDir, log: log, defaultBranch: defaultBranch, shallow: shallow}
+	}
+	return cliGit{sourceDir: sourceDir, log: log, defaultBranch: defaultBranch, shallow: shallow}
+}
+
+// remoteGit returns the git of the project's source directory
+// set up with the project's credentials.
+func remoteGit(project storage.Project, log io.Writer) (git, error) {
+	var err error
+	switch g := projectGit(project, log).(type) {
+	case cliGit:
+		g.env, err = remoteEnv(project)
+		return g, err
+	case goGit:
+		g.auth, err = remoteAuth(project)
+		return g, err
+	default:
+		return g, nil
+	}
+}
+
+// askpassVar is set in the environment of git commands when butler
+// is their askpass program.
+const askpassVar = "BUTLER_ASKPASS"
+
+// remoteEnv returns variables that make git use the project's credentials
+// and nothing else, neither the keys in ~/.ssh nor credential helpers.
+func remoteEnv(project storage.Project) ([]string, error) {
+	env := []string{
+		// Fail instead of waiting for someone to type a password.
+		"GIT_TERMINAL_PROMPT=0",
+	}
+	if project.Remote == nil {
+		return env, nil
+	}
+	auth := project.Remote.Auth
+
+	if auth.SSHKey != "" || len(auth.KnownHosts) > 0 {
+		ssh := "ssh -F /dev/null"
+		if auth.SSHKey != "" {
+			key, err := filepath.Abs(auth.SSHKey)
+			if err != nil {
+				return nil, err
+			}
+			ssh += " -i " + shellQuote(key) + " -o IdentitiesOnly=yes -o IdentityAgent=none"
+		}
+		if len(auth.KnownHosts) > 0 {
+			p, err := storage.KnownHosts(project.Name, project.Remote.Auth.KnownHosts)
+			if err != nil {
+				return nil, err
+			}
+			ssh += " -o UserKnownHostsFile=" + shellQuote(p) + " -o GlobalKnownHostsFile=/dev/null -o StrictHostKeyChecking=yes"
+		}
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+
+	if auth.TokenSecret != "" {
+		username, token, err := remoteToken(project)
+		if err != nil {
+			return nil, err
+		}
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env,
+			// Only butler gets asked for the password.
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=credential.helper",
+			"GIT_CONFIG_VALUE_0=",
+			"GIT_ASKPASS="+self,
+			askpassVar+"=1",
+			"BUTLER_ASKPASS_USERNAME="+username,
+			"BUTLER_ASKPASS_TOKEN="+token,
+		)
+	}
+	return env, nil
+}
+
+// remoteAuth returns the project's credentials for go-git.
+func remoteAuth(project storage.Project) (transport.AuthMethod, error) {
+	if project.Remote == nil {
+		return nil, nil
+	}
+	auth := project.Remote.Auth
+	if auth.TokenSecret != "" {
+		username, token, err := remoteToken(project)
+		if err != nil {
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: username, Password: token}, nil
+	}
+	if auth.SSHKey == "" {
+		if len(auth.KnownHosts) > 0 {
+			return nil, fmt.Errorf("knownHosts needs sshKey with the go-git backend")
+		}
+		return nil, nil
+	}
+	user := "git"
+	if e, err := transport.NewEndpoint(project.Remote.URL); err == nil && e.User != "" {
+		user = e.User
+	}
+	keys, err := gitssh.NewPublicKeysFromFile(user, auth.SSHKey, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(auth.KnownHosts) > 0 {
+		p, err := storage.KnownHosts(project.Name, project.Remote.Auth.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		keys.HostKeyCallback, err = gitssh.NewKnownHostsCallback(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// remoteToken returns the username and the token for HTTPS remotes.
+func remoteToken(project storage.Project) (string, string, error) {
+	auth := project.Remote.Auth
+	secrets, err := storage.Secrets(project.Name)
+	if err != nil {
+		return "", "", err
+	}
+	token, ok := secrets[auth.TokenSecret]
+	if !ok {
+		return "", "", fmt.Errorf("no secret %s for the repository token", auth.TokenSecret)
+	}
+	username := auth.Username
+	if username == "" {
+		username = "git"
+	}
+	return username, token, nil
+}
+
+// askpass answers a git prompt for a username or a password
+// with the values git was given by remoteEnv.
+func askpass(prompt string) {
+	if strings.HasPrefix(prompt, "Username") {
+		fmt.Println(os.Getenv("BUTLER_ASKPASS_USERNAME"))
+		return
+	}
+	fmt.Println(os.Getenv("BUTLER_ASKPASS_TOKEN"))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// prepareSource makes sure a project with a remote has a usable clone,
+// cloning the repository again if the clone is missing or broken.
+// Projects cloned by hand are left as they are.
+func prepareSource(project storage.Project, g git) error {
+	if project.Remote == nil {
+		return nil
+	}
+	err := g.check()
+	if err == nil {
+		return g.setRemote(project.Remote.URL)
+	}
+	// The directory is deleted only if there's no clone to lose.
+	var nc *noCloneError
+	if !errors.As(err, &nc) {
+		return fmt.Errorf("failed to check the clone: %v", err)
+	}
+	if _, err := os.Stat(g.dir()); err == nil {
+		slog.Warn("source directory is not a valid clone, cloning again", "project", project.Name, "reason", nc.reason)
+	} else {
+		slog.Info("cloning", "project", project.Name, "url", project.Remote.URL)
+	}
+	err = os.RemoveAll(g.dir())
+	if err != nil {
+		return err
+	}
+	err = g.clone(project.Remote)
+	if err != nil {
+		os.RemoveAll(g.dir())
+		return fmt.Errorf("failed to clone: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+func gitBackends(dir string) map[string]git {
+	return map[string]git{
+		"git":    cliGit{sourceDir: dir},
+		"go-git": goGit{sourceDir: dir},
+	}
+}
+
+func TestCheckClone(t *testing.T) {
+	bare, _ := gitRepo(t)
+	for name, g := range gitBackends(t.TempDir() + "/src") {
+		t.Run(name, func(t *testing.T) {
+			var nc *noCloneError
+			if err := g.check(); !errors.As(err, &nc) {
+				t.Errorf("got %v without a directory", err)
+			}
+			if err := os.MkdirAll(g.dir(), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.check(); !errors.As(err, &nc) {
+				t.Errorf("got %v without .git", err)
+			}
+			os.RemoveAll(g.dir())
+
+			err := g.clone(&storage.Remote{URL: bare, Branch: "master"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := g.check(); err != nil {
+				t.Errorf("got %v for a clone", err)
+			}
+
+			// A lock left by a killed git doesn't make the clone broken.
+			ioutil.WriteFile(g.dir()+"/.git/index.lock", nil, 0666)
+			if err := g.check(); err != nil {
+				t.Errorf("got %v for a locked clone", err)
+			}
+
+			// Without objects the clone is broken.
+			objects, _ := filepath.Glob(g.dir() + "/.git/objects/*/*")
+			for _, f := range objects {
+				os.Remove(f)
+			}
+			if err := g.check(); !errors.As(err, &nc) {
+				t.Errorf("got %v for a clone without objects", err)
+			}
+		})
+	}
+}
+
+// Both backends tell a broken clone from a problem that a fix
+// elsewhere can solve.
+func TestCheckBrokenClone(t *testing.T) {
+	bare, work := gitRepo(t)
+	commit(t, work, "second")
+	runGit(t, work, "push", "-q", "origin", "master")
+	missing := strings.Repeat("1", 40)
+	for _, c := range []struct {
+		name   string
+		broken bool
+		spoil  func(t *testing.T, dir string)
+	}{
+		{"garbage HEAD", true, func(t *testing.T, dir string) {
+			ioutil.WriteFile(dir+"/.git/HEAD", []byte("garbage\n"), 0666)
+		}},
+		{"branch to a missing commit", true, func(t *testing.T, dir string) {
+			ioutil.WriteFile(dir+"/.git/refs/heads/master", []byte(missing+"\n"), 0666)
+		}},
+		{"corrupted pack", true, func(t *testing.T, dir string) {
+			packs, _ := filepath.Glob(dir + "/.git/objects/pack/*.pack")
+			if len(packs) == 0 {
+				t.Fatal("no packs in the clone")
+			}
+			for _, f := range packs {
+				os.Chmod(f, 0666)
+				ioutil.WriteFile(f, []byte("garbage"), 0666)
+			}
+		}},
+		{"corrupted commit", true, func(t *testing.T, dir string) {
+			h := commit(t, dir, "local")
+			f := dir + "/.git/objects/" + h[:2] + "/" + h[2:]
+			os.Chmod(f, 0666)
+			if err := ioutil.WriteFile(f, []byte("garbage"), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		// Nothing is missing, there's just nothing checked out.
+		{"unborn branch", false, func(t *testing.T, dir string) {
+			runGit(t, dir, "symbolic-ref", "HEAD", "refs/heads/none")
+		}},
+	} {
+		for _, name := range []string{"git", "go-git"} {
+			g := gitBackends(t.TempDir() + "/src")[name]
+			t.Run(c.name+"/"+name, func(t *testing.T) {
+				// Cloned through a transport to get a pack of its own
+				// instead of links to the objects of the bare repository.
+				err := g.clone(&storage.Remote{URL: "file://" + bare, Branch: "master"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.spoil(t, g.dir())
+				err = g.check()
+				var nc *noCloneError
+				if err == nil || errors.As(err, &nc) != c.broken {
+					t.Errorf("got %v, want broken = %v", err, c.broken)
+				}
+			})
+		}
+	}
+}
+
+// A clone is never deleted because of a problem that has nothing to do
+// with the clone itself.
+func TestPrepareSourceKeepsClone(t *testing.T) {
+	bare, _ := gitRepo(t)
+	inTempDir(t)
+	project := storage.Project{Name: "app", Remote: &storage.Remote{URL: bare, Branch: "master"}}
+	g := projectGit(project, nil)
+	if err := prepareSource(project, g); err != nil {
+		t.Fatal(err)
+	}
+	marker := g.dir() + "/.git/marker"
+	ioutil.WriteFile(marker, nil, 0666)
+
+	// Git is nowhere to be found.
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	err := prepareSource(project, g)
+	os.Setenv("PATH", path)
+	if err == nil {
+		t.Error("no error without git")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatal("the clone was deleted")
+	}
+
+	// A broken clone is cloned again.
+	os.RemoveAll(g.dir() + "/.git/refs")
+	os.RemoveAll(g.dir() + "/.git/packed-refs")
+	os.RemoveAll(g.dir() + "/.git/HEAD")
+	if err := prepareSource(project, g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("the broken clone was kept")
+	}
+	if err := g.check(); err != nil {
+		t.Errorf("got %v after cloning again", err)
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// A build is first written to a staging directory and then moved to its
+// place under builds/ in one rename, so that readers never see partial builds.
+func stagingPath(project, branch, version string) string {
+	return "projects/" + project + "/staging/" + branchKey(branch) + "/" + safeString(version)
+}
+
+// Commit saves the staged build of the given project, branch and version
+// to the storage, replacing the previous build of the same version if any.
+func Commit(project, branch, version string) error {
+	staging := stagingPath(project, branch, version)
+	err := syncFiles(staging)
+	if err != nil {
+		return err
+	}
+	err = syncDir(staging)
+	if err != nil {
+		return err
+	}
+	err = backend.Save(project, branchKey(branch), safeString(version), staging)
+	if err != nil {
+		return err
+	}
+	// The local storage moves the directory, others copy it.
+	return os.RemoveAll(staging)
+}
+
+// copyFile copies a file and syncs the copy to disk. If the copying fails,
+// the partial copy is removed.
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to)
+		return fmt.Errorf("failed to copy %s to %s: %v", from, to, err)
+	}
+	return nil
+}
+
+// writeFile writes a file and syncs it to disk.
+func writeFile(p string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic replaces a file so that readers see either the old
+// or the new contents, even if the process dies while writing.
+func writeFileAtomic(p string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	err = writeFile(tmpPath, data, perm)
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, p)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(path.Dir(p))
+}
+
+// syncFiles syncs all files in the given directory to disk.
+func syncFiles(dir string) error {
+	files, err := lsf(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		f, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir syncs a directory's entries to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
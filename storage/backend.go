@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// File is a build file opened for reading.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// Storage keeps finished builds.
+//
+// A build is first assembled in a local staging directory by BuildLogger,
+// SaveBuilds and SaveInfo, and then Commit hands it over to the storage
+// in one piece. Branch names given to a storage are already converted
+// to keys with branchKey, and version and file names with safeString.
+type Storage interface {
+	// Has returns true if there is a saved build for the given project,
+	// branch and version.
+	Has(project, branch, version string) bool
+
+	// Save stores the files from the given local directory as the build
+	// of the given project, branch and version, replacing the previous
+	// build of the same version if any. Readers must never see a partially
+	// saved build.
+	Save(project, branch, version, dir string) error
+
+	// Build opens a build file. If there is no such file, the returned
+	// error satisfies os.IsNotExist.
+	Build(project, branch, version, file string) (File, error)
+
+	// Move moves the build of the given version from one branch to another.
+	Move(project, from, to, version string) error
+
+	// Branches returns the keys of the project's branches that have builds.
+	Branches(project string) ([]string, error)
+
+	// Versions returns the versions built on the given branch.
+	Versions(project, branch string) ([]string, error)
+
+	// Builds returns the names of the given build's files.
+	Builds(project, branch, version string) ([]string, error)
+}
+
+// backend is where the builds are kept.
+var backend Storage = Local()
+
+// SetBackend changes where the builds are kept.
+func SetBackend(s Storage) {
+	backend = s
+}
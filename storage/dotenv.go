@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// parseDotEnv reads a .env file and returns its variables as a list
+// of "name=value" strings in the order they are defined.
+//
+// Lines have the form "NAME=value" with an optional "export " prefix.
+// Blank lines and lines starting with "#" are ignored. Unquoted values
+// are trimmed and end at a " #" comment. Values in single quotes are
+// taken literally. Values in double quotes may contain escapes (\n, \t,
+// \", \\, \$). Quoted values may span multiple lines. References like
+// $NAME, ${NAME} and ${NAME:-default} in unquoted and double-quoted values
+// are replaced with values of variables defined earlier in the file or,
+// failing that, in the server's environment.
+func parseDotEnv(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &dotenvParser{
+		src:    string(data),
+		line:   1,
+		values: make(map[string]string),
+	}
+	list, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", path, p.line, err)
+	}
+	return list, nil
+}
+
+type dotenvParser struct {
+	src    string
+	pos    int
+	line   int
+	names  []string
+	values map[string]string
+}
+
+func (p *dotenvParser) parse() ([]string, error) {
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.src) {
+			break
+		}
+		if p.peek() == '#' {
+			p.skipLine()
+			continue
+		}
+		err := p.parseAssignment()
+		if err != nil {
+			return nil, err
+		}
+	}
+	list := make([]string, len(p.names))
+	for i, name := range p.names {
+		list[i] = name + "=" + p.values[name]
+	}
+	return list, nil
+}
+
+func (p *dotenvParser) peek() byte {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *dotenvParser) next() byte {
+	ch := p.src[p.pos]
+	p.pos++
+	if ch == '\n' {
+		p.line++
+	}
+	return ch
+}
+
+// skipBlank skips whitespace including line breaks.
+func (p *dotenvParser) skipBlank() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.peek()) >= 0 {
+		p.next()
+	}
+}
+
+// skipSpace skips whitespace within the line.
+func (p *dotenvParser) skipSpace() {
+	for p.pos < len(p.src) && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+func (p *dotenvParser) skipLine() {
+	for p.pos < len(p.src) && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+func isNameChar(ch byte, first bool) bool {
+	return ch == '_' ||
+		(ch >= 'A' && ch <= 'Z') ||
+		(ch >= 'a' && ch <= 'z') ||
+		(!first && ch >= '0' && ch <= '9')
+}
+
+func (p *dotenvParser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.peek(), p.pos == start) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *dotenvParser) parseAssignment() error {
+	name := p.name()
+	if name == "export" && (p.peek() == ' ' || p.peek() == '\t') {
+		p.skipSpace()
+		name = p.name()
+	}
+	if name == "" {
+		return fmt.Errorf("expected a variable name, got %q", p.rest())
+	}
+	p.skipSpace()
+	if p.peek() != '=' {
+		return fmt.Errorf("expected '=' after %s, got %q", name, p.rest())
+	}
+	p.next()
+	p.skipSpace()
+
+	var value string
+	var err error
+	switch p.peek() {
+	case '\'':
+		value, err = p.singleQuoted()
+	case '"':
+		value, err = p.doubleQuoted()
+	default:
+		value, err = p.unquoted()
+	}
+	if err != nil {
+		return err
+	}
+
+	// After a quoted value only a comment may follow.
+	p.skipSpace()
+	if p.pos < len(p.src) && p.peek() != '\n' && p.peek() != '\r' && p.peek() != '#' {
+		return fmt.Errorf("unexpected %q after the value of %s", p.rest(), name)
+	}
+	p.skipLine()
+
+	if _, ok := p.values[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.values[name] = value
+	return nil
+}
+
+// rest returns the remainder of the current line for error messages.
+func (p *dotenvParser) rest() string {
+	s := p.src[p.pos:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+func (p *dotenvParser) singleQuoted() (string, error) {
+	line := p.line
+	p.next()
+	start := p.pos
+	for p.pos < len(p.src) {
+		if p.next() == '\'' {
+			return p.src[start : p.pos-1], nil
+		}
+	}
+	p.line = line
+	return "", fmt.Errorf("unterminated single-quoted value")
+}
+
+func (p *dotenvParser) doubleQuoted() (string, error) {
+	line := p.line
+	p.next()
+	b := strings.Builder{}
+	for p.pos < len(p.src) {
+		ch := p.next()
+		switch ch {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.pos >= len(p.src) {
+				break
+			}
+			esc := p.next()
+			switch esc {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\', '$':
+				b.WriteByte(esc)
+			case '\n':
+				// A backslash at the end of a line joins the lines.
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(esc)
+			}
+		case '$':
+			s, err := p.reference()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	p.line = line
+	return "", fmt.Errorf("unterminated double-quoted value")
+}
+
+func (p *dotenvParser) unquoted() (string, error) {
+	b := strings.Builder{}
+	for p.pos < len(p.src) && p.peek() != '\n' {
+		ch := p.peek()
+		if ch == '#' && (b.Len() == 0 || strings.HasSuffix(b.String(), " ") || strings.HasSuffix(b.String(), "\t")) {
+			break
+		}
+		p.next()
+		if ch == '$' {
+			s, err := p.reference()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// reference parses a variable reference after a "$" and returns its value.
+// A "$" that doesn't start a reference is kept as is.
+func (p *dotenvParser) reference() (string, error) {
+	if p.peek() != '{' {
+		name := p.name()
+		if name == "" {
+			return "$", nil
+		}
+		return p.lookup(name), nil
+	}
+	p.next()
+	name := p.name()
+	if name == "" {
+		return "", fmt.Errorf("invalid variable reference: ${%s", p.rest())
+	}
+	value := p.lookup(name)
+	if strings.HasPrefix(p.src[p.pos:], ":-") {
+		p.pos += 2
+		start := p.pos
+		for p.pos < len(p.src) && p.peek() != '}' && p.peek() != '\n' {
+			p.pos++
+		}
+		if value == "" {
+			value = p.src[start:p.pos]
+		}
+	}
+	if p.peek() != '}' {
+		return "", fmt.Errorf("unterminated variable reference ${%s", name)
+	}
+	p.next()
+	return value, nil
+}
+
+func (p *dotenvParser) lookup(name string) string {
+	if v, ok := p.values[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
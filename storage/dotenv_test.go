@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseDotEnvString(t *testing.T, src string) ([]string, error) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), ".env")
+	err := ioutil.WriteFile(p, []byte(src), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseDotEnv(p)
+}
+
+func TestParseDotEnv(t *testing.T) {
+	t.Setenv("BUTLER_TEST_HOST", "host")
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"empty", "", []string{}},
+		{"plain", "A=1\nB=two words\n", []string{"A=1", "B=two words"}},
+		{"no final newline", "A=1", []string{"A=1"}},
+		{"crlf", "A=1\r\nB=2\r\n", []string{"A=1", "B=2"}},
+		{"blank lines and comments", "\n# comment\n  \nA=1\n\t# indented\n", []string{"A=1"}},
+		{"export", "export A=1\nexport=2\n", []string{"A=1", "export=2"}},
+		{"spaces around", "  A  =  1  \n", []string{"A=1"}},
+		{"empty value", "A=\nB=''\nC=\"\"\n", []string{"A=", "B=", "C="}},
+		{"trailing comment", "A=1 # one\nB=x#y\nC=#z\n", []string{"A=1", "B=x#y", "C="}},
+		{"single quoted", `A='a $B \n "q"' # c`, []string{`A=a $B \n "q"`}},
+		{"double quoted escapes", `A="l1\nl2\t\"q\" \\ \$X \z"`, []string{"A=l1\nl2\t\"q\" \\ $X \\z"}},
+		{"multiline single", "A='l1\nl2'\nB=3", []string{"A=l1\nl2", "B=3"}},
+		{"multiline double", "A=\"l1\nl2\"\nB=3", []string{"A=l1\nl2", "B=3"}},
+		{"line continuation", "A=\"l1\\\nl2\"", []string{"A=l1l2"}},
+		{"hash in quotes", `A="x # y"`, []string{"A=x # y"}},
+		{"references", "A=1\nB=$A-${A}\nC=\"$A\"\nD='$A'", []string{"A=1", "B=1-1", "C=1", "D=$A"}},
+		{"host reference", "A=$BUTLER_TEST_HOST", []string{"A=host"}},
+		{"undefined reference", "A=x${BUTLER_TEST_UNDEFINED}y", []string{"A=xy"}},
+		{"default", "A=${BUTLER_TEST_UNDEFINED:-def}\nB=${BUTLER_TEST_HOST:-def}", []string{"A=def", "B=host"}},
+		{"empty default", "A=${BUTLER_TEST_UNDEFINED:-}", []string{"A="}},
+		{"lone dollar", "A=$ 5\nB=a$", []string{"A=$ 5", "B=a$"}},
+		{"later reference", "A=$B\nB=1", []string{"A=", "B=1"}},
+		{"redefinition", "A=1\nB=2\nA=3\nC=$A", []string{"A=3", "B=2", "C=3"}},
+		{"unicode", "A=привет ✓", []string{"A=привет ✓"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDotEnvString(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDotEnvErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line string
+	}{
+		{"A=1\n=2\n", ":2:"},
+		{"A=1\nB 2\n", ":2:"},
+		{"A=1\n\n1A=2\n", ":3:"},
+		{"A=1\nB='open\nC=3\n", ":2:"},
+		{"A=1\nB=\"open\nC=3\n", ":2:"},
+		{"A='x' y\n", ":1:"},
+		{"A=\"x\" y\n", ":1:"},
+		{"A=1\nB=${C\n", ":2:"},
+		{"A=${}\n", ":1:"},
+		{"A=\"${C:-x\"\n", ":1:"},
+	}
+	for _, tt := range tests {
+		_, err := parseDotEnvString(t, tt.src)
+		if err == nil {
+			t.Errorf("%q: no error", tt.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.line) {
+			t.Errorf("%q: error %q doesn't point to line %s", tt.src, err, tt.line)
+		}
+	}
+}
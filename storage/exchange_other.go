@@ -0,0 +1,11 @@
+//go:build !linux
+
+package storage
+
+import "errors"
+
+// exchange swaps two directories in one step.
+// Only Linux can do that.
+func exchange(a, b string) error {
+	return errors.New("exchanging directories is not supported")
+}
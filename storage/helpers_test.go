@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+// inTempDir runs the rest of the test in a new empty working directory,
+// since the storage keeps its files relative to the working directory.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	return dir
+}
+
+// saveBuild commits a build with the given description and files.
+func saveBuild(t *testing.T, project, branch, version string, info *BuildInfo, files map[string]string) {
+	t.Helper()
+	dir := stagingPath(project, branch, version)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		err := writeFile(dir+"/"+name, []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info != nil {
+		err = SaveInfo(project, branch, version, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = Commit(project, branch, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Build and cell statuses.
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// BuildInfo describes the outcome of a build of one project version.
+type BuildInfo struct {
+	Number   int       `json:"number"`
+	Commit   string    `json:"commit"`
+	Author   string    `json:"author"`
+	Message  string    `json:"message"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Cells    []Cell    `json:"cells"`
+
+	// Requested is true for builds requested through the API.
+	Requested bool `json:"requested,omitempty"`
+}
+
+// Cell is the result of running one builder with one variant.
+type Cell struct {
+	Builder  string        `json:"builder"`
+	Dir      string        `json:"dir"`
+	Variant  string        `json:"variant"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Files    []string      `json:"files"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Env      []EnvVar      `json:"env,omitempty"`
+}
+
+// EnvVar is an environment variable a build was run with.
+type EnvVar struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+const infoName = "build.json"
+
+// Hidden returns true for files that are kept with a build
+// but not given out to clients.
+func Hidden(file string) bool {
+	return file == infoName
+}
+
+// SaveInfo writes the build description for the given project, branch
+// and version. Like other results, it's visible only after Commit.
+func SaveInfo(project, branch, version string, info *BuildInfo) error {
+	data, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := stagingPath(project, branch, version)
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	return writeFile(dir+"/"+infoName, data, 0666)
+}
+
+// Info returns the build description for the given project, branch and version.
+// Builds made before descriptions were introduced have none, in which case
+// the returned error satisfies os.IsNotExist.
+func Info(project, branch, version string) (*BuildInfo, error) {
+	data, err := readBuildFile(project, branch, version, infoName)
+	if err != nil {
+		return nil, err
+	}
+	info := &BuildInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func readBuildFile(project, branch, version, name string) ([]byte, error) {
+	r, err := Build(project, branch, version, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
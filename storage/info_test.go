@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInfoHidden(t *testing.T) {
+	inTempDir(t)
+	saveBuild(t, "app", "master", "1.0.0", &BuildInfo{Number: 3, Status: StatusOK}, map[string]string{
+		"app.apk":   "apk",
+		"build.log": "log",
+	})
+	files, err := Builds("app", "master", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"app.apk", "build.log"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("Builds = %q, want %q", files, want)
+	}
+	info, err := Info("app", "master", "1.0.0")
+	if err != nil || info.Number != 3 {
+		t.Errorf("Info = %+v, %v", info, err)
+	}
+	if !Hidden("build.json") || Hidden("app.apk") {
+		t.Error("Hidden is wrong")
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// branchKey returns the name under which builds of the given branch are
+// stored. Letters, digits, dots and dashes are kept as they are, and every
+// other byte is written as "_" followed by its two hex digits, so that
+// different branches never share a directory, and the original name can
+// always be recovered with branchName.
+func branchKey(branch string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(branch); i++ {
+		ch := branch[i]
+		keep := ch == '-' || (ch == '.' && i > 0) ||
+			(ch >= '0' && ch <= '9') ||
+			(ch >= 'A' && ch <= 'Z') ||
+			(ch >= 'a' && ch <= 'z')
+		if keep {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "_%02x", ch)
+	}
+	return b.String()
+}
+
+// branchName returns the branch name for the given storage key.
+// Malformed escapes are left as they are.
+func branchName(key string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(key); i++ {
+		if key[i] == '_' && i+2 < len(key) {
+			if ch, err := strconv.ParseUint(key[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(ch))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(key[i])
+	}
+	return b.String()
+}
+
+// MigrateBranches moves the project's builds stored under branch names
+// made by the old lossy conversion, where "feature/login" and
+// "feature-login" were both stored as "feature-login", to their proper keys.
+// Every stored build is looked at. Its branch is taken from the build number
+// index if the build is there, and otherwise guessed from the given names of
+// the repository's branches and the branches stored under proper keys: the
+// build is moved if exactly one of them had the old name and none has it now.
+// Returns the number of builds moved.
+func MigrateBranches(project string, branches []string) (int, error) {
+	refs, err := BuildNumbers(project)
+	if err != nil {
+		return 0, err
+	}
+	// The index has the latest build of a version last, and that's the
+	// build whose files are in the version's directory now.
+	owners := make(map[string]string)
+	for _, r := range refs {
+		if r.Branch == ReleasesDirectory {
+			continue
+		}
+		owners[safeString(r.Branch)+"/"+safeString(r.Version)] = r.Branch
+	}
+
+	keys, err := backend.Branches(project)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, old := range keys {
+		if old == ReleasesDirectory {
+			continue
+		}
+		known := append([]string{}, branches...)
+		for _, key := range keys {
+			if key != old {
+				known = append(known, branchName(key))
+			}
+		}
+		guess, ok := legacyOwner(old, known)
+		versions, err := backend.Versions(project, old)
+		if err != nil {
+			return moved, err
+		}
+		for _, version := range versions {
+			branch, indexed := owners[old+"/"+version]
+			if !indexed {
+				if !ok {
+					continue
+				}
+				branch = guess
+			}
+			key := branchKey(branch)
+			if key == old {
+				continue
+			}
+			if backend.Has(project, key, version) {
+				// Already migrated, or rebuilt under the new key.
+				continue
+			}
+			err = backend.Move(project, old, key, version)
+			if err != nil {
+				return moved, fmt.Errorf("failed to move %s/%s: %v", old, version, err)
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// legacyOwner returns the branch from the list whose builds the old lossy
+// conversion stored under the given key, if there's exactly one such branch
+// and no branch on the list is stored under the key now.
+func legacyOwner(key string, branches []string) (string, bool) {
+	owner := ""
+	for _, b := range branches {
+		if branchKey(b) == key {
+			return "", false
+		}
+		if safeString(b) == key && b != owner {
+			if owner != "" {
+				return "", false
+			}
+			owner = b
+		}
+	}
+	return owner, owner != ""
+}
+
+// LegacyBranch returns the branch whose builds were stored under the given
+// name by the old lossy conversion and have been moved since, for addresses
+// that still use the old name. If the name is a stored branch itself or
+// could belong to more than one branch, it returns false.
+func LegacyBranch(project, name string) (string, bool) {
+	keys, err := backend.Branches(project)
+	if err != nil {
+		return "", false
+	}
+	stored := make([]string, len(keys))
+	for i, key := range keys {
+		stored[i] = branchName(key)
+	}
+	return legacyOwner(branchKey(name), stored)
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBranchKey(t *testing.T) {
+	for _, name := range []string{"master", "feature/login", "feature-login", "feature_login", ".hidden", "a.b", "ветка", "<x>"} {
+		key := branchKey(name)
+		if got := branchName(key); got != name {
+			t.Errorf("%q is stored as %q, which gives back %q", name, key, got)
+		}
+		if strings.ContainsAny(key, "/\\ ") || key[0] == '.' {
+			t.Errorf("%q is stored as unsafe %q", name, key)
+		}
+	}
+	if branchKey("feature/login") == branchKey("feature-login") {
+		t.Error("different branches share a key")
+	}
+}
+
+// oldBuild saves a build under a key made by the old conversion.
+func oldBuild(t *testing.T, key, version string) {
+	t.Helper()
+	dir := "projects/app/builds/" + key + "/" + version
+	err := os.MkdirAll(dir, 0777)
+	if err == nil {
+		err = writeFile(dir+"/app.apk", []byte(key), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateBranches(t *testing.T) {
+	inTempDir(t)
+	// In the index.
+	oldBuild(t, "feature-login", "1.0.0")
+	err := appendNumber("app", "1\tfeature/login\t1.0.0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not in the index, but only one branch of the repository fits.
+	oldBuild(t, "fix-crash", "1.0.1")
+	// Not in the index, and the name belongs to a branch as it is.
+	oldBuild(t, "hotfix-1", "1.0.2")
+	// Not in the index, and two branches fit.
+	oldBuild(t, "a-b", "1.0.3")
+
+	branches := []string{"feature/login", "fix/crash", "hotfix-1", "hotfix/1", "a/b", "a b"}
+	n, err := MigrateBranches("app", branches)
+	if err != nil || n != 2 {
+		t.Fatalf("MigrateBranches = %d, %v, want 2", n, err)
+	}
+	for _, b := range []struct{ branch, version string }{
+		{"feature/login", "1.0.0"},
+		{"fix/crash", "1.0.1"},
+		{"hotfix-1", "1.0.2"},
+		{"a-b", "1.0.3"},
+	} {
+		if !Has("app", b.branch, b.version) {
+			t.Errorf("%s is not on %s", b.version, b.branch)
+		}
+	}
+
+	// Running it again changes nothing.
+	n, err = MigrateBranches("app", branches)
+	if err != nil || n != 0 {
+		t.Errorf("second MigrateBranches = %d, %v", n, err)
+	}
+}
+
+// Without the repository, branches stored under proper keys tell
+// where the old builds of a branch belong.
+func TestMigrateBranchesStored(t *testing.T) {
+	inTempDir(t)
+	oldBuild(t, "fix-crash", "1.0.0")
+	oldBuild(t, branchKey("fix/crash"), "1.0.1")
+	n, err := MigrateBranches("app", nil)
+	if err != nil || n != 1 || !Has("app", "fix/crash", "1.0.0") {
+		t.Errorf("MigrateBranches = %d, %v", n, err)
+	}
+}
+
+func TestLegacyBranch(t *testing.T) {
+	inTempDir(t)
+	oldBuild(t, branchKey("fix/crash"), "1.0.0")
+	if b, ok := LegacyBranch("app", "fix-crash"); !ok || b != "fix/crash" {
+		t.Errorf("LegacyBranch = %q, %v", b, ok)
+	}
+	if _, ok := LegacyBranch("app", "fix/crash"); ok {
+		t.Error("a stored branch is taken for an old name")
+	}
+
+	// The old name is a branch too.
+	oldBuild(t, "fix-crash", "1.0.1")
+	if _, ok := LegacyBranch("app", "fix-crash"); ok {
+		t.Error("a stored branch is redirected")
+	}
+}
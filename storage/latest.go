@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// compareVersions compares version strings so that numeric parts are
+// compared as numbers: "1.9.0" < "1.10.0" and "1.2.0-9" < "1.2.0-10".
+// It returns a negative number if a < b, zero if a == b and a positive
+// number otherwise.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ca, ra := versionChunk(a)
+		cb, rb := versionChunk(b)
+		na, errA := strconv.Atoi(ca)
+		nb, errB := strconv.Atoi(cb)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return na - nb
+			}
+		case errA == nil:
+			return 1
+		case errB == nil:
+			return -1
+		default:
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+		}
+		a, b = ra, rb
+	}
+	return len(a) - len(b)
+}
+
+// versionChunk splits a string into its leading run of digits or non-digits
+// and the rest.
+func versionChunk(s string) (string, string) {
+	digit := s[0] >= '0' && s[0] <= '9'
+	i := 1
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// sortVersions sorts versions from the newest to the oldest.
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) > 0
+	})
+}
+
+// Latest returns the newest successful build's version for the given branch.
+// For releases the newest is the one with the highest version, for other
+// branches it's the one that finished last. Builds made before build
+// descriptions were introduced are assumed successful. Requested builds
+// are not considered. If there are no successful builds, the returned
+// error satisfies os.IsNotExist.
+func Latest(project, branch string) (string, error) {
+	versions, err := Versions(project, branch)
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+	var latestTime time.Time
+	for _, v := range versions {
+		info, err := Info(project, branch, v)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if info != nil && (info.Status != StatusOK || info.Requested) {
+			continue
+		}
+		if branchKey(branch) == ReleasesDirectory {
+			// The versions are sorted, the first good one is the newest.
+			return v, nil
+		}
+		var t time.Time
+		if info != nil {
+			t = info.Finished
+		}
+		if latest == "" || t.After(latestTime) {
+			latest = v
+			latestTime = t
+		}
+	}
+	if latest == "" {
+		return "", os.ErrNotExist
+	}
+	return latest, nil
+}
+
+// RequestedVersion returns the version to save a requested build of the
+// given version as, so that it doesn't replace the regular build:
+// the version with the first free "-r<n>" suffix.
+func RequestedVersion(project, branch, version string) string {
+	for n := 1; ; n++ {
+		v := fmt.Sprintf("%s-r%d", version, n)
+		if !Has(project, branch, v) {
+			return v
+		}
+	}
+}
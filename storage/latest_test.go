@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	// Each version is older than the next one.
+	ordered := []string{
+		"",
+		"0.9",
+		"1.0",
+		"1.0.0",
+		"1.0.0-1",
+		"1.0.0-2",
+		"1.0.0-10",
+		"1.2",
+		"1.9",
+		"1.10",
+		"1.10.1",
+		"2.0.0",
+		"10.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			got := compareVersions(ordered[i], ordered[j])
+			switch {
+			case i < j && got >= 0, i > j && got <= 0, i == j && got != 0:
+				t.Errorf("compareVersions(%q, %q) = %d", ordered[i], ordered[j], got)
+			}
+		}
+	}
+
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.9.0", "1.10.0", -1},
+		{"1.2.0-9", "1.2.0-10", -1},
+		{"v1.9", "v1.10", -1},
+		{"1.0.0-beta", "1.0.0-alpha", 1},
+		// Leading zeros don't matter.
+		{"01.0", "1.0", 0},
+	}
+	for _, tt := range tests {
+		got := compareVersions(tt.a, tt.b)
+		if (got < 0 && tt.want >= 0) || (got > 0 && tt.want <= 0) || (got == 0 && tt.want != 0) {
+			t.Errorf("compareVersions(%q, %q) = %d, want the sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	versions := []string{"1.9.0", "1.10.0", "1.2.0-10", "1.2.0-9", "1.2.0"}
+	sortVersions(versions)
+	if want := []string{"1.10.0", "1.9.0", "1.2.0-10", "1.2.0-9", "1.2.0"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("sorted %q, want %q", versions, want)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	inTempDir(t)
+	now := time.Now()
+	if _, err := Latest("app", "master"); !os.IsNotExist(err) {
+		t.Errorf("Latest without builds: %v", err)
+	}
+
+	// Branches: the one that finished last, whatever the version.
+	saveBuild(t, "app", "master", "1.10.0", &BuildInfo{Status: StatusOK, Finished: now}, nil)
+	saveBuild(t, "app", "master", "1.9.0", &BuildInfo{Status: StatusOK, Finished: now.Add(time.Minute)}, nil)
+	saveBuild(t, "app", "master", "1.11.0", &BuildInfo{Status: StatusFailed, Finished: now.Add(2 * time.Minute)}, nil)
+	saveBuild(t, "app", "master", "1.9.0-r1", &BuildInfo{Status: StatusOK, Finished: now.Add(3 * time.Minute), Requested: true}, nil)
+	if v, err := Latest("app", "master"); v != "1.9.0" || err != nil {
+		t.Errorf("Latest = %s, %v, want 1.9.0", v, err)
+	}
+
+	// Releases: the highest version.
+	saveBuild(t, "app", ReleasesDirectory, "1.9.0", &BuildInfo{Status: StatusOK, Finished: now.Add(time.Minute)}, nil)
+	saveBuild(t, "app", ReleasesDirectory, "1.10.0", &BuildInfo{Status: StatusOK, Finished: now}, nil)
+	saveBuild(t, "app", ReleasesDirectory, "1.10.0-1", &BuildInfo{Status: StatusOK, Finished: now}, nil)
+	saveBuild(t, "app", ReleasesDirectory, "1.10.0-1-r1", &BuildInfo{Status: StatusOK, Finished: now, Requested: true}, nil)
+	saveBuild(t, "app", ReleasesDirectory, "2.0.0", &BuildInfo{Status: StatusFailed, Finished: now}, nil)
+	if v, err := Latest("app", ReleasesDirectory); v != "1.10.0-1" || err != nil {
+		t.Errorf("Latest release = %s, %v, want 1.10.0-1", v, err)
+	}
+
+	// Only failed and requested builds.
+	saveBuild(t, "app", "develop", "3.0.0", &BuildInfo{Status: StatusFailed}, nil)
+	saveBuild(t, "app", "develop", "3.0.0-r1", &BuildInfo{Status: StatusOK, Requested: true}, nil)
+	if v, err := Latest("app", "develop"); !os.IsNotExist(err) {
+		t.Errorf("Latest = %s, %v, want no build", v, err)
+	}
+}
+
+func TestRequestedBuilds(t *testing.T) {
+	inTempDir(t)
+	now := time.Now()
+	saveBuild(t, "app", "master", "1.0.0", &BuildInfo{Status: StatusOK, Finished: now}, nil)
+	if v := RequestedVersion("app", "master", "1.0.0"); v != "1.0.0-r1" {
+		t.Errorf("RequestedVersion = %s, want 1.0.0-r1", v)
+	}
+	saveBuild(t, "app", "master", "1.0.0-r1", &BuildInfo{Status: StatusOK, Finished: now.Add(time.Minute), Requested: true}, nil)
+	if v := RequestedVersion("app", "master", "1.0.0"); v != "1.0.0-r2" {
+		t.Errorf("RequestedVersion = %s, want 1.0.0-r2", v)
+	}
+	if v, err := Latest("app", "master"); v != "1.0.0" {
+		t.Errorf("Latest = %s, %v, want the regular build", v, err)
+	}
+
+	saveBuild(t, "app", ReleasesDirectory, "1.0.0", &BuildInfo{Status: StatusOK}, nil)
+	saveBuild(t, "app", ReleasesDirectory, "1.0.0-r1", &BuildInfo{Status: StatusOK, Requested: true}, nil)
+	if v, err := Latest("app", ReleasesDirectory); v != "1.0.0" {
+		t.Errorf("Latest release = %s, %v, want the regular build", v, err)
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// localStorage keeps builds in the projects directory, next to their sources.
+type localStorage struct{}
+
+// Local returns a storage that keeps builds on the local disk
+// in projects/<project>/builds.
+func Local() Storage {
+	return &localStorage{}
+}
+
+func (l *localStorage) dir(project, branch, version string) string {
+	return "projects/" + project + "/builds/" + branch + "/" + version
+}
+
+func (l *localStorage) Has(project, branch, version string) bool {
+	_, err := os.Stat(l.dir(project, branch, version))
+	return err == nil
+}
+
+func (l *localStorage) Save(project, branch, version, dir string) error {
+	final := l.dir(project, branch, version)
+	err := os.MkdirAll(path.Dir(final), 0777)
+	if err != nil {
+		return err
+	}
+
+	old := ""
+	if _, err := os.Stat(final); err == nil {
+		// The staged build is renamed so that if butler dies after the
+		// swap, the old build left in its place is not taken for
+		// an interrupted one.
+		old = fmt.Sprintf("%s.old-%d", dir, time.Now().UnixNano())
+		err = os.Rename(dir, old)
+		if err != nil {
+			return err
+		}
+		// Swap the new build with the old one, so that the version
+		// is never missing.
+		err = exchange(old, final)
+		if err == nil {
+			err = syncDir(path.Dir(final))
+			if err != nil {
+				return err
+			}
+			return os.RemoveAll(old)
+		}
+		err = os.Rename(old, dir)
+		if err != nil {
+			return err
+		}
+		// Where directories can't be swapped, the old build has to be
+		// moved out of the way first, since a directory can't be renamed
+		// over a non-empty one.
+		err = os.Rename(final, old)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(dir, final)
+	if err != nil {
+		if old != "" {
+			os.Rename(old, final)
+		}
+		return err
+	}
+	err = syncDir(path.Dir(final))
+	if err != nil {
+		return err
+	}
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+func (l *localStorage) Move(project, from, to, version string) error {
+	final := l.dir(project, to, version)
+	err := os.MkdirAll(path.Dir(final), 0777)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.dir(project, from, version), final)
+	if err != nil {
+		return err
+	}
+	// Remove the old branch directory if that was its last build.
+	os.Remove(path.Dir(l.dir(project, from, version)))
+	return syncDir(path.Dir(final))
+}
+
+func (l *localStorage) Build(project, branch, version, file string) (File, error) {
+	return os.Open(l.dir(project, branch, version) + "/" + file)
+}
+
+func (l *localStorage) Branches(project string) ([]string, error) {
+	dirs, err := lsd("projects/" + project + "/builds")
+	if err != nil {
+		return nil, err
+	}
+	return baseNames(dirs), nil
+}
+
+func (l *localStorage) Versions(project, branch string) ([]string, error) {
+	dirs, err := lsd("projects/" + project + "/builds/" + branch)
+	if err != nil {
+		return nil, err
+	}
+	return baseNames(dirs), nil
+}
+
+func (l *localStorage) Builds(project, branch, version string) ([]string, error) {
+	files, err := lsf(l.dir(project, branch, version))
+	if err != nil {
+		return nil, err
+	}
+	return baseNames(files), nil
+}
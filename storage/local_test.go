@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestLocalSaveReplaces(t *testing.T) {
+	inTempDir(t)
+	saveBuild(t, "app", "master", "1.0.0", nil, map[string]string{"a.apk": "1", "old.apk": "1"})
+	saveBuild(t, "app", "master", "1.0.0", nil, map[string]string{"a.apk": "2"})
+	files, err := Builds("app", "master", "1.0.0")
+	if err != nil || len(files) != 1 || files[0] != "a.apk" {
+		t.Errorf("Builds = %q, %v, want only the new build's files", files, err)
+	}
+	data, _ := ioutil.ReadFile("projects/app/builds/master/1.0.0/a.apk")
+	if string(data) != "2" {
+		t.Errorf("a.apk has %q, want the new build", data)
+	}
+	if dirs, _ := lsd("projects/app/staging/master"); len(dirs) != 0 {
+		t.Errorf("left in staging: %q", dirs)
+	}
+}
+
+// A version being rebuilt must never be missing.
+func TestLocalSaveAtomic(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("directories can be swapped only on Linux")
+	}
+	inTempDir(t)
+	saveBuild(t, "app", "master", "1.0.0", nil, map[string]string{"a.apk": "0"})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	missing := 0
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if !Has("app", "master", "1.0.0") {
+				missing++
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		saveBuild(t, "app", "master", "1.0.0", nil, map[string]string{"a.apk": "x"})
+	}
+	close(done)
+	wg.Wait()
+	if missing > 0 {
+		t.Errorf("the build was missing %d times while being replaced", missing)
+	}
+}
+
+func TestRecoverRemovesReplaced(t *testing.T) {
+	inTempDir(t)
+	os.MkdirAll("projects/app/staging/master/1.0.0.old-123", 0777)
+	recovered, err := RecoverInterrupted("app")
+	if err != nil || len(recovered) != 0 {
+		t.Errorf("RecoverInterrupted = %+v, %v, want nothing", recovered, err)
+	}
+	if _, err := os.Stat("projects/app/staging/master/1.0.0.old-123"); !os.IsNotExist(err) {
+		t.Error("the replaced build was not removed")
+	}
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Names of the build log, the manifest file and its signature
+// in a version directory.
+const (
+	LogName       = "build.log"
+	ManifestName  = "manifest.json"
+	SignatureName = "manifest.json.sig"
+)
+
+// SigningKeyPath is the file with the private key used to sign manifests.
+// If there is no such file, manifests are not signed.
+const SigningKeyPath = "signing.key"
+
+// ErrIntegrity is returned when a build file doesn't match its manifest.
+var ErrIntegrity = errors.New("file doesn't match the manifest")
+
+// Artifact is a build output along with where it came from.
+type Artifact struct {
+	Path    string
+	Builder string
+	Dir     string
+	Variant string
+}
+
+// Manifest describes the artifacts of a build.
+type Manifest struct {
+	Project string          `json:"project"`
+	Branch  string          `json:"branch"`
+	Version string          `json:"version"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes one artifact.
+type ManifestEntry struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Builder string `json:"builder"`
+	Dir     string `json:"dir"`
+	Variant string `json:"variant"`
+}
+
+// writeManifest writes the manifest for the saved artifacts and signs it
+// if there is a signing key.
+func writeManifest(project, branch, version string, files []Artifact) error {
+	dir := stagingPath(project, branch, version)
+	m := Manifest{
+		Project: project,
+		Branch:  branch,
+		Version: version,
+		Files:   make([]ManifestEntry, len(files)),
+	}
+	for i, f := range files {
+		name := path.Base(f.Path)
+		size, sum, err := hashFile(dir + "/" + name)
+		if err != nil {
+			return err
+		}
+		m.Files[i] = ManifestEntry{
+			Name:    name,
+			Size:    size,
+			SHA256:  sum,
+			Builder: f.Builder,
+			Dir:     f.Dir,
+			Variant: f.Variant,
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeFile(dir+"/"+ManifestName, data, 0666)
+	if err != nil {
+		return err
+	}
+
+	key, err := signingKey()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return writeFile(dir+"/"+SignatureName, []byte(sig+"\n"), 0666)
+}
+
+func hashFile(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	return hash(f)
+}
+
+func hash(f io.Reader) (int64, string, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// signingKey reads the key for signing manifests.
+func signingKey() (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(SigningKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(trimNewline(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key in %s", SigningKeyPath)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func trimNewline(data []byte) []byte {
+	for len(data) > 0 && (data[len(data)-1] == '\n' || data[len(data)-1] == '\r') {
+		data = data[:len(data)-1]
+	}
+	return data
+}
+
+// GenerateSigningKey creates a new key for signing manifests
+// and returns its public part. An existing key is not overwritten.
+func GenerateSigningKey() (ed25519.PublicKey, error) {
+	if _, err := os.Stat(SigningKeyPath); err == nil {
+		return nil, fmt.Errorf("%s already exists", SigningKeyPath)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+	err = ioutil.WriteFile(SigningKeyPath, []byte(seed+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// PublicKey returns the public key for verifying manifest signatures.
+// If there is no signing key, the returned error satisfies os.IsNotExist.
+func PublicKey() (ed25519.PublicKey, error) {
+	key, err := signingKey()
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// readManifest reads the build's manifest and checks its signature.
+// Builds saved before manifests were introduced have none, in which case
+// nil is returned. Manifests written before the signing key was created
+// are not signed and are accepted as they are.
+func readManifest(project, branch, version string) (*Manifest, error) {
+	f, err := Build(project, branch, version, ManifestName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := signingKey()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if key != nil {
+		sig, err := readBuildFile(project, branch, version, SignatureName)
+		if os.IsNotExist(err) && signedSince(f) {
+			return nil, fmt.Errorf("%w: the manifest is not signed", ErrIntegrity)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: failed to read signature: %v", ErrIntegrity, err)
+		}
+		if err == nil {
+			sig, err = base64.StdEncoding.DecodeString(string(trimNewline(sig)))
+			if err != nil || !ed25519.Verify(key.Public().(ed25519.PublicKey), data, sig) {
+				return nil, fmt.Errorf("%w: invalid manifest signature", ErrIntegrity)
+			}
+		}
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIntegrity, err)
+	}
+	return m, nil
+}
+
+// signedSince returns false if the manifest file is older than the signing
+// key, that is, was written when manifests weren't signed yet. Remote storages
+// keep modification times in whole seconds, so a manifest written in the same
+// second as the key counts as written after it.
+func signedSince(manifest File) bool {
+	st, err := manifest.Stat()
+	if err != nil {
+		return true
+	}
+	key, err := os.Stat(SigningKeyPath)
+	if err != nil {
+		return true
+	}
+	return !st.ModTime().Before(key.ModTime().Truncate(time.Second))
+}
+
+// unlisted are the build files that are not artifacts
+// and so are not listed in the manifest.
+var unlisted = []string{LogName, ManifestName, SignatureName}
+
+// maxVerified limits how many files are remembered as verified.
+const maxVerified = 10000
+
+// verified remembers the results of checking files, so that they are not
+// hashed again on every request as long as they don't change. It's keyed
+// by the file's path, with the checksum, size and mtime the file was checked
+// with. Files of remote storages that are being checked are in checking.
+var verified = struct {
+	sync.Mutex
+	files    map[string]verdict
+	checking map[string]bool
+	wg       sync.WaitGroup
+}{files: make(map[string]verdict), checking: make(map[string]bool)}
+
+// verdict is the result of checking a file.
+type verdict struct {
+	stamp string
+	err   error
+}
+
+// Verify checks that the build file matches the build's manifest and
+// returns the file's manifest entry. The build log and the manifest itself
+// are not checked, and for them the entry is nil. Other files not listed
+// in the manifest are refused. If the file doesn't match, the returned
+// error wraps ErrIntegrity. Builds saved before manifests were introduced
+// are not checked.
+//
+// Hashing a file of a remote storage means downloading it once more,
+// so such files are hashed in the background, and until that is done,
+// only their sizes are checked.
+func Verify(project, branch, version, file string) (*ManifestEntry, error) {
+	m, err := readManifest(project, branch, version)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	for _, e := range m.Files {
+		if e.Name != safeString(file) {
+			continue
+		}
+		e := e
+		f, err := Build(project, branch, version, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if st.Size() != e.Size {
+			return nil, fmt.Errorf("%w: %s has %d bytes instead of %d", ErrIntegrity, e.Name, st.Size(), e.Size)
+		}
+
+		key := fmt.Sprintf("%s/%s/%s/%s", project, branchKey(branch), safeString(version), e.Name)
+		stamp := fmt.Sprintf("%s %d %d", e.SHA256, st.Size(), st.ModTime().UnixNano())
+		verified.Lock()
+		v, ok := verified.files[key]
+		verified.Unlock()
+		if ok && v.stamp == stamp {
+			return &e, v.err
+		}
+		if _, local := backend.(*localStorage); local {
+			err := checkSum(f, e)
+			remember(key, verdict{stamp, err})
+			return &e, err
+		}
+
+		verified.Lock()
+		if !verified.checking[key] {
+			verified.checking[key] = true
+			verified.wg.Add(1)
+			go func() {
+				defer verified.wg.Done()
+				// A damaged file is refused from the next request on.
+				remember(key, verdict{stamp, checkFile(project, branch, version, e)})
+				verified.Lock()
+				delete(verified.checking, key)
+				verified.Unlock()
+			}()
+		}
+		verified.Unlock()
+		return &e, nil
+	}
+	for _, name := range unlisted {
+		if safeString(file) == name {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not in the manifest", ErrIntegrity, file)
+}
+
+// checkFile opens the build file and compares its checksum with the entry.
+func checkFile(project, branch, version string, e ManifestEntry) error {
+	f, err := Build(project, branch, version, e.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkSum(f, e)
+}
+
+func checkSum(f io.Reader, e ManifestEntry) error {
+	_, sum, err := hash(f)
+	if err != nil {
+		return err
+	}
+	if sum != e.SHA256 {
+		return fmt.Errorf("%w: %s has a wrong checksum", ErrIntegrity, e.Name)
+	}
+	return nil
+}
+
+// remember saves the result of checking a file.
+func remember(key string, v verdict) {
+	if v.err != nil && !errors.Is(v.err, ErrIntegrity) {
+		// Failed to read the file, try again next time.
+		return
+	}
+	verified.Lock()
+	defer verified.Unlock()
+	if len(verified.files) >= maxVerified {
+		// Forget some file to make room, it will just be hashed again.
+		for k := range verified.files {
+			delete(verified.files, k)
+			break
+		}
+	}
+	verified.files[key] = v
+}
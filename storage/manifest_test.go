@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// saveArtifacts commits a build of app/master/1.0.0 with the given artifacts.
+func saveArtifacts(t *testing.T, files map[string]string) {
+	t.Helper()
+	os.MkdirAll("out", 0777)
+	artifacts := make([]Artifact, 0)
+	for name, data := range files {
+		ioutil.WriteFile("out/"+name, []byte(data), 0666)
+		artifacts = append(artifacts, Artifact{Path: "out/" + name, Builder: "npm", Dir: ".", Variant: "default"})
+	}
+	os.MkdirAll(stagingPath("app", "master", "1.0.0"), 0777)
+	writeFile(stagingPath("app", "master", "1.0.0")+"/"+LogName, []byte("log"), 0666)
+	err := SaveBuilds("app", "master", "1.0.0", artifacts)
+	if err == nil {
+		err = Commit("app", "master", "1.0.0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func buildPath(name string) string {
+	return "projects/app/builds/master/1.0.0/" + name
+}
+
+func TestVerify(t *testing.T) {
+	inTempDir(t)
+	saveArtifacts(t, map[string]string{"app.apk": "apk data", "app.aab": "aab data"})
+
+	e, err := Verify("app", "master", "1.0.0", "app.apk")
+	if err != nil || e == nil || e.Size != 8 || e.Builder != "npm" {
+		t.Fatalf("Verify = %+v, %v", e, err)
+	}
+	for _, name := range []string{LogName, ManifestName} {
+		e, err := Verify("app", "master", "1.0.0", name)
+		if err != nil || e != nil {
+			t.Errorf("Verify(%s) = %+v, %v, want no entry and no error", name, e, err)
+		}
+	}
+
+	// A file slipped into the build is refused.
+	ioutil.WriteFile(buildPath("extra.apk"), []byte("x"), 0666)
+	if _, err := Verify("app", "master", "1.0.0", "extra.apk"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify of an unlisted file = %v, want ErrIntegrity", err)
+	}
+
+	// A changed file is refused, whether or not its size changed.
+	ioutil.WriteFile(buildPath("app.aab"), []byte("aab dat"), 0666)
+	if _, err := Verify("app", "master", "1.0.0", "app.aab"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify of a truncated file = %v, want ErrIntegrity", err)
+	}
+	ioutil.WriteFile(buildPath("app.aab"), []byte("AAB data"), 0666)
+	if _, err := Verify("app", "master", "1.0.0", "app.aab"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify of a changed file = %v, want ErrIntegrity", err)
+	}
+
+	// A verified file that changes later is checked again.
+	ioutil.WriteFile(buildPath("app.apk"), []byte("APK data"), 0666)
+	os.Chtimes(buildPath("app.apk"), time.Now(), time.Now().Add(time.Hour))
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify of a file changed after verification = %v, want ErrIntegrity", err)
+	}
+}
+
+func TestVerifyWithoutManifest(t *testing.T) {
+	inTempDir(t)
+	saveBuild(t, "app", "master", "1.0.0", nil, map[string]string{"old.apk": "x"})
+	e, err := Verify("app", "master", "1.0.0", "old.apk")
+	if err != nil || e != nil {
+		t.Errorf("Verify of a build without a manifest = %+v, %v", e, err)
+	}
+}
+
+func TestVerifiedCacheBounded(t *testing.T) {
+	inTempDir(t)
+	saveArtifacts(t, map[string]string{"app.apk": "apk data"})
+	verified.Lock()
+	verified.files = make(map[string]verdict)
+	for i := 0; i < maxVerified; i++ {
+		verified.files[string(rune(i))] = verdict{stamp: "x"}
+	}
+	verified.Unlock()
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); err != nil {
+		t.Fatal(err)
+	}
+	verified.Lock()
+	n := len(verified.files)
+	verified.files = make(map[string]verdict)
+	verified.Unlock()
+	if n > maxVerified {
+		t.Errorf("%d files remembered, want at most %d", n, maxVerified)
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	inTempDir(t)
+	pub, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateSigningKey(); err == nil {
+		t.Error("an existing key was overwritten")
+	}
+	if key, err := PublicKey(); err != nil || !key.Equal(pub) {
+		t.Errorf("PublicKey = %v, %v", key, err)
+	}
+	saveArtifacts(t, map[string]string{"app.apk": "apk data"})
+
+	data, _ := ioutil.ReadFile(buildPath(ManifestName))
+	sig, _ := ioutil.ReadFile(buildPath(SignatureName))
+	if len(sig) == 0 {
+		t.Fatal("the manifest was not signed")
+	}
+	m := &Manifest{}
+	json.Unmarshal(data, m)
+	if m.Project != "app" || m.Version != "1.0.0" || len(m.Files) != 1 {
+		t.Errorf("manifest = %+v", m)
+	}
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); err != nil {
+		t.Errorf("Verify = %v", err)
+	}
+
+	// A manifest changed to match a changed file is refused.
+	ioutil.WriteFile(buildPath("app.apk"), []byte("bad data"), 0666)
+	m.Files[0].SHA256 = "0000"
+	data, _ = json.Marshal(m)
+	ioutil.WriteFile(buildPath(ManifestName), data, 0666)
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify with a changed manifest = %v, want ErrIntegrity", err)
+	}
+
+	os.Remove(buildPath(SignatureName))
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify without a signature = %v, want ErrIntegrity", err)
+	}
+}
+
+// Builds made before the signing key was created keep working.
+func TestManifestBeforeKey(t *testing.T) {
+	inTempDir(t)
+	saveArtifacts(t, map[string]string{"app.apk": "apk data"})
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(buildPath(ManifestName), hourAgo, hourAgo)
+	if _, err := GenerateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); err != nil {
+		t.Errorf("Verify of an old build = %v", err)
+	}
+
+	// A bad signature is refused even on an old manifest.
+	ioutil.WriteFile(buildPath(SignatureName), []byte("AAAA\n"), 0666)
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify with a bad signature = %v, want ErrIntegrity", err)
+	}
+
+	// An unsigned manifest written after the key is refused.
+	os.Remove(buildPath(SignatureName))
+	os.Chtimes(buildPath(ManifestName), time.Now(), time.Now())
+	if _, err := Verify("app", "master", "1.0.0", "app.apk"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify of a new unsigned manifest = %v, want ErrIntegrity", err)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+)
+
+// Mask is what secret values are replaced with in build logs.
+const Mask = "***"
+
+// maskWriter replaces given values with a mask in the stream written to it.
+// Because a value may be split between writes, the end of every write that
+// could be the beginning of a value is held back until the next write or Close.
+type maskWriter struct {
+	w       io.WriteCloser
+	values  [][]byte
+	pending []byte
+}
+
+func newMaskWriter(w io.WriteCloser, values []string) io.WriteCloser {
+	m := &maskWriter{w: w}
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		m.values = append(m.values, []byte(v))
+	}
+	if len(m.values) == 0 {
+		return w
+	}
+	// Replace longer values first so that a value containing another one
+	// is masked entirely.
+	sort.Slice(m.values, func(i, j int) bool {
+		return len(m.values[i]) > len(m.values[j])
+	})
+	return m
+}
+
+func (m *maskWriter) Write(p []byte) (int, error) {
+	m.pending = append(m.pending, p...)
+	err := m.flush(false)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes out the pending data with the values masked. Unless it's
+// the final flush, it stops at the first place where a value might begin
+// but is cut off by the end of the data.
+func (m *maskWriter) flush(final bool) error {
+	out := make([]byte, 0, len(m.pending))
+	i := 0
+scan:
+	for i < len(m.pending) {
+		rest := m.pending[i:]
+		if !final {
+			for _, v := range m.values {
+				if len(rest) < len(v) && bytes.HasPrefix(v, rest) {
+					break scan
+				}
+			}
+		}
+		masked := false
+		for _, v := range m.values {
+			if bytes.HasPrefix(rest, v) {
+				out = append(out, Mask...)
+				i += len(v)
+				masked = true
+				break
+			}
+		}
+		if !masked {
+			out = append(out, rest[0])
+			i++
+		}
+	}
+	m.pending = append(m.pending[:0], m.pending[i:]...)
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := m.w.Write(out)
+	return err
+}
+
+func (m *maskWriter) Close() error {
+	err := m.flush(true)
+	m.pending = nil
+	cerr := m.w.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
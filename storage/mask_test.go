@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestMaskWriter(t *testing.T) {
+	values := []string{"secret", "sec", "topsecretvalue"}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"no values here", "no values here"},
+		{"the secret is out", "the *** is out"},
+		{"secretsecret", "******"},
+		{"a topsecretvalue", "a ***"},
+		{"sec and secret", "*** and ***"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		// Split the input at every position and in single bytes
+		// to check values cut between writes.
+		splits := [][]string{{tt.in}, strings.Split(tt.in, "")}
+		for i := 0; i <= len(tt.in); i++ {
+			splits = append(splits, []string{tt.in[:i], tt.in[i:]})
+		}
+		for _, parts := range splits {
+			var out closeBuffer
+			w := newMaskWriter(&out, values)
+			for _, p := range parts {
+				n, err := w.Write([]byte(p))
+				if err != nil || n != len(p) {
+					t.Fatalf("Write = %d, %v", n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("%q written as %q: got %q, want %q", tt.in, parts, out.String(), tt.want)
+			}
+			if !out.closed {
+				t.Error("the underlying writer was not closed")
+			}
+		}
+	}
+}
+
+func TestMaskWriterNoValues(t *testing.T) {
+	var out closeBuffer
+	w := newMaskWriter(&out, []string{""})
+	if w != &out {
+		t.Error("a writer without values should not wrap the output")
+	}
+}
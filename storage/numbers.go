@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BuildRef tells where the build with the given number is stored.
+type BuildRef struct {
+	Number  int    `json:"number"`
+	Branch  string `json:"branch"`
+	Version string `json:"version"`
+}
+
+// numbersLock serializes allocation of build numbers.
+var numbersLock sync.Mutex
+
+func numbersPath(project string) string {
+	return "projects/" + project + "/buildnumbers"
+}
+
+// NewBuildNumber returns a new build number for the given project and
+// records that the build is stored under the given branch and version.
+// Build numbers of a project start with 1 and only grow.
+func NewBuildNumber(project, branch, version string) (int, error) {
+	numbersLock.Lock()
+	defer numbersLock.Unlock()
+
+	_, last, err := readNumbers(project)
+	if err != nil {
+		return 0, err
+	}
+	n := last + 1
+	err = appendNumber(project, fmt.Sprintf("%d\t%s\t%s\n", n, branch, version))
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// appendNumber adds a line to the index.
+func appendNumber(project, line string) error {
+	// The index is only appended to, and every line is synced before
+	// the number is given out, so a number is never given twice.
+	f, err := os.OpenFile(numbersPath(project), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !endsWithNewline(numbersPath(project)) {
+		// Finish a line cut short by a crash so it doesn't swallow this one.
+		line = "\n" + line
+	}
+	_, err = f.WriteString(line)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// BuildNumbers returns all numbered builds of the project, oldest first.
+func BuildNumbers(project string) ([]BuildRef, error) {
+	refs, _, err := readNumbers(project)
+	return refs, err
+}
+
+// readNumbers returns the builds from the index and the last number given out.
+func readNumbers(project string) ([]BuildRef, int, error) {
+	refs := make([]BuildRef, 0)
+	f, err := os.Open(numbersPath(project))
+	if os.IsNotExist(err) {
+		return refs, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	last := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Split(s.Text(), "\t")
+		if len(parts) != 3 {
+			// A line could be cut short by a crash while writing it.
+			continue
+		}
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		if n > last {
+			last = n
+		}
+		refs = append(refs, BuildRef{Number: n, Branch: parts[1], Version: parts[2]})
+	}
+	return refs, last, s.Err()
+}
+
+// BuildByNumber returns where the build with the given number is stored.
+// If there is no such build, the returned error satisfies os.IsNotExist.
+func BuildByNumber(project string, number int) (*BuildRef, error) {
+	refs, err := BuildNumbers(project)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		if r.Number == number {
+			return &r, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// endsWithNewline returns true if the file is empty, missing or ends with a newline.
+func endsWithNewline(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.Size() == 0 {
+		return true
+	}
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, st.Size()-1)
+	return err != nil || b[0] == '\n'
+}
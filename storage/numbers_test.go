@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBuildNumbers(t *testing.T) {
+	inTempDir(t)
+	os.MkdirAll("projects/app", 0777)
+	for i, b := range []BuildRef{{Branch: "master", Version: "1.0.0"}, {Branch: "dev/x", Version: "1.0.0-1-gabc"}} {
+		n, err := NewBuildNumber("app", b.Branch, b.Version)
+		if err != nil || n != i+1 {
+			t.Fatalf("NewBuildNumber = %d, %v, want %d", n, err, i+1)
+		}
+	}
+
+	// A line cut short by a crash is skipped and doesn't swallow the next one.
+	f, _ := os.OpenFile(numbersPath("app"), os.O_WRONLY|os.O_APPEND, 0666)
+	f.WriteString("3\tmas")
+	f.Close()
+	n, err := NewBuildNumber("app", "master", "1.0.1")
+	if err != nil || n != 3 {
+		t.Fatalf("NewBuildNumber after a cut line = %d, %v, want 3", n, err)
+	}
+
+	refs, err := BuildNumbers("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BuildRef{
+		{Number: 1, Branch: "master", Version: "1.0.0"},
+		{Number: 2, Branch: "dev/x", Version: "1.0.0-1-gabc"},
+		{Number: 3, Branch: "master", Version: "1.0.1"},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("BuildNumbers = %+v, want %+v", refs, want)
+	}
+	b, err := BuildByNumber("app", 2)
+	if err != nil || *b != want[1] {
+		t.Errorf("BuildByNumber(2) = %+v, %v", b, err)
+	}
+	if _, err := BuildByNumber("app", 4); !os.IsNotExist(err) {
+		t.Errorf("BuildByNumber(4) error = %v, want not exist", err)
+	}
+}
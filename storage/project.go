@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dependency links a branch of an upstream project to a branch of
+// a downstream project that has to be rebuilt after the upstream one.
+type Dependency struct {
+	// Project is the other project: the upstream one in a project's
+	// DependsOn list and the downstream one in its Triggers list.
+	Project string `json:"project"`
+
+	// Branch is the upstream branch, "master" by default.
+	Branch string `json:"branch"`
+
+	// Target is the downstream branch, "master" by default.
+	Target string `json:"target"`
+}
+
+// Remote describes the repository of a project whose clone
+// butler manages itself.
+type Remote struct {
+	// URL is the address of the repository.
+	URL string `json:"url"`
+
+	// Branch is the default branch. It's checked out after cloning and
+	// built along with the usual branches. Defaults to "master".
+	Branch string `json:"branch"`
+
+	// Depth, if above zero, makes a shallow clone with that many commits.
+	Depth int `json:"depth"`
+
+	// Filter, if given, makes a partial clone, for example with "blob:none".
+	Filter string `json:"filter"`
+
+	// Auth has the credentials for the repository.
+	Auth Auth `json:"auth"`
+}
+
+// Auth has credentials for a project's repository.
+type Auth struct {
+	// SSHKey is the path to the private key for SSH URLs.
+	SSHKey string `json:"sshKey"`
+
+	// KnownHosts has the lines of a known_hosts file with the keys the
+	// SSH server may have. If given, no other keys are accepted.
+	KnownHosts []string `json:"knownHosts"`
+
+	// TokenSecret is the name of the project secret with the token
+	// or password for HTTPS URLs.
+	TokenSecret string `json:"tokenSecret"`
+
+	// Username goes with the token, "git" by default.
+	Username string `json:"username"`
+}
+
+// projectConfig is the contents of a project's project.json file.
+type projectConfig struct {
+	DependsOn []Dependency `json:"dependsOn"`
+	Triggers  []Dependency `json:"triggers"`
+	Remote    *Remote      `json:"remote"`
+
+	// Overrides has patterns of names of variables that build
+	// requests may set.
+	Overrides []string `json:"overrides"`
+
+	// PollInterval is the number of seconds between updates of the project.
+	PollInterval int `json:"pollInterval"`
+}
+
+func readProjectConfig(dir string) (*projectConfig, error) {
+	cfg := &projectConfig{}
+	data, err := ioutil.ReadFile(dir + "/project.json")
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s/project.json: %v", dir, err)
+	}
+	if cfg.Remote != nil {
+		if cfg.Remote.URL == "" {
+			return nil, fmt.Errorf("%s/project.json: remote url is missing", dir)
+		}
+		if cfg.Remote.Branch == "" {
+			cfg.Remote.Branch = "master"
+		}
+	}
+	for _, list := range [][]Dependency{cfg.DependsOn, cfg.Triggers} {
+		for i := range list {
+			if list[i].Branch == "" {
+				list[i].Branch = "master"
+			}
+			if list[i].Target == "" {
+				list[i].Target = "master"
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// KnownHosts writes the given host keys to the project's known_hosts file
+// for ssh and returns the file's absolute path. The file is rewritten only
+// when the keys change, and is replaced in one step, so that a git command
+// running at the same time never reads it half-written.
+func KnownHosts(project string, keys []string) (string, error) {
+	p, err := filepath.Abs("projects/" + project + "/known_hosts")
+	if err != nil {
+		return "", err
+	}
+	data := []byte(strings.Join(keys, "\n") + "\n")
+	old, err := ioutil.ReadFile(p)
+	if err == nil && bytes.Equal(old, data) {
+		return p, nil
+	}
+	err = writeFileAtomic(p, data, 0600)
+	if err != nil {
+		return "", err
+	}
+	return p, nil
+}
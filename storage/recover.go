@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Interrupted is a build that was left unfinished when butler stopped.
+// Its origin is empty if the log's header couldn't be read.
+type Interrupted struct {
+	BuildRef
+	Origin Origin
+}
+
+// RecoverInterrupted finds the project's builds that were left unfinished
+// in the staging directory when butler stopped, and saves each of them as
+// a failed build with its log, dropping whatever files it had produced.
+// Returns the recovered builds, so that they can be made again.
+func RecoverInterrupted(project string) ([]Interrupted, error) {
+	keys, err := lsd("projects/" + project + "/staging")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	refs, err := BuildNumbers(project)
+	if err != nil {
+		return nil, err
+	}
+
+	recovered := make([]Interrupted, 0)
+	for _, keyDir := range keys {
+		key := path.Base(keyDir)
+		versions, err := lsd(keyDir)
+		if err != nil {
+			return recovered, err
+		}
+		for _, dir := range versions {
+			version := path.Base(dir)
+			if strings.Contains(version, ".old-") {
+				// A build replaced by Save when butler died, not a staged one.
+				err := os.RemoveAll(dir)
+				if err != nil {
+					return recovered, err
+				}
+				continue
+			}
+			// The build was numbered when it started, and its number
+			// is the last one given to this branch and version.
+			b := BuildRef{Branch: branchName(key), Version: version}
+			for _, r := range refs {
+				if branchKey(r.Branch) == key && safeString(r.Version) == version {
+					b = r
+				}
+			}
+			origin, err := abandon(project, b, dir)
+			if err != nil {
+				return recovered, fmt.Errorf("failed to recover %s/%s: %v", key, version, err)
+			}
+			recovered = append(recovered, Interrupted{b, origin})
+		}
+		// Remove the branch directory if it's empty now.
+		os.Remove(keyDir)
+	}
+	return recovered, nil
+}
+
+// abandon saves the staged build in the given directory as failed
+// and returns the build's origin.
+func abandon(project string, b BuildRef, dir string) (Origin, error) {
+	started, origin, _ := readLogHeader(dir + "/" + LogName)
+	files, err := lsf(dir)
+	if err != nil {
+		return origin, err
+	}
+	for _, f := range files {
+		if path.Base(f) == LogName {
+			continue
+		}
+		err := os.Remove(f)
+		if err != nil {
+			return origin, err
+		}
+	}
+	f, err := os.OpenFile(dir+"/"+LogName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return origin, err
+	}
+	fmt.Fprintf(f, "\n=== interrupted by a restart ===\n")
+	f.Close()
+
+	err = SaveInfo(project, b.Branch, b.Version, &BuildInfo{
+		Number:    b.Number,
+		Started:   started,
+		Finished:  time.Now(),
+		Status:    StatusFailed,
+		Error:     "interrupted by a restart",
+		Cells:     []Cell{},
+		Requested: origin.Requested,
+	})
+	if err != nil {
+		return origin, err
+	}
+	return origin, Commit(project, b.Branch, b.Version)
+}
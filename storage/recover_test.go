@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// An interrupted build keeps the time it started, and not the time
+// its staging directory was last changed.
+func TestRecoverStarted(t *testing.T) {
+	inTempDir(t)
+	os.MkdirAll("projects/app", 0777)
+	n, err := NewBuildNumber("app", "master", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	log, err := BuildLogger("app", "master", "1.0.0", Origin{Ref: "refs/heads/master"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write([]byte("compiling\n"))
+	log.Close()
+	// The build went on for an hour.
+	later := before.Add(time.Hour)
+	os.Chtimes(stagingPath("app", "master", "1.0.0"), later, later)
+
+	recovered, err := RecoverInterrupted("app")
+	if err != nil || len(recovered) != 1 || recovered[0].Number != n {
+		t.Fatalf("RecoverInterrupted = %+v, %v", recovered, err)
+	}
+	if want := (Origin{Ref: "refs/heads/master"}); recovered[0].Origin != want {
+		t.Errorf("origin %+v, want %+v", recovered[0].Origin, want)
+	}
+	info, err := Info("app", "master", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != StatusFailed || info.Number != n {
+		t.Errorf("recovered as %+v", info)
+	}
+	if d := info.Started.Sub(before); d < 0 || d > time.Minute {
+		t.Errorf("started at %v, want about %v", info.Started, before)
+	}
+}
+
+// What was built is read back from the log.
+func TestRecoverOrigin(t *testing.T) {
+	inTempDir(t)
+	builds := []struct {
+		branch, version string
+		origin          Origin
+	}{
+		{ReleasesDirectory, "1.0.0", Origin{Ref: "refs/tags/1.0.0"}},
+		{ReleasesDirectory, "1.0.0-r1", Origin{Ref: "refs/tags/1.0.0", Requested: true}},
+		{"master", "1.0.0-3-gabcdef0-r1", Origin{Ref: "refs/heads/master", Requested: true}},
+	}
+	for _, b := range builds {
+		log, err := BuildLogger("app", b.branch, b.version, b.origin, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.Close()
+	}
+	// A log without a header.
+	os.MkdirAll(stagingPath("app", "develop", "2.0.0"), 0777)
+	writeFile(stagingPath("app", "develop", "2.0.0")+"/"+LogName, []byte("compiling\n"), 0666)
+
+	recovered, err := RecoverInterrupted("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]Origin)
+	for _, r := range recovered {
+		got[r.Branch+"/"+r.Version] = r.Origin
+	}
+	for _, b := range builds {
+		if o := got[b.branch+"/"+b.version]; o != b.origin {
+			t.Errorf("%s/%s: origin %+v, want %+v", b.branch, b.version, o, b.origin)
+		}
+		info, err := Info("app", b.branch, b.version)
+		if err != nil || info.Requested != b.origin.Requested || info.Status != StatusFailed {
+			t.Errorf("%s/%s: recovered as %+v, %v", b.branch, b.version, info, err)
+		}
+	}
+	if o, ok := got["develop/2.0.0"]; !ok || o != (Origin{}) {
+		t.Errorf("build without a header: %+v, %v", o, ok)
+	}
+}
+
+func TestLogHeader(t *testing.T) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 6, time.FixedZone("X", 3600))
+	for _, origin := range []Origin{
+		{Ref: "refs/heads/feature/login"},
+		{Ref: "refs/tags/1.0.0", Requested: true},
+	} {
+		line := logHeader(started, origin)
+		p := t.TempDir() + "/build.log"
+		writeFile(p, []byte(line+"\nmore\n"), 0666)
+		gotTime, gotOrigin, ok := readLogHeader(p)
+		if !ok || !gotTime.Equal(started) || gotOrigin != origin {
+			t.Errorf("%q read as %v, %+v, %v", line, gotTime, gotOrigin, ok)
+		}
+	}
+	for _, line := range []string{"", "compiling", "build started at yesterday from refs/heads/master", "build started at 2024-01-02T03:04:05Z"} {
+		p := t.TempDir() + "/build.log"
+		writeFile(p, []byte(line+"\n"), 0666)
+		if _, _, ok := readLogHeader(p); ok {
+			t.Errorf("%q is read as a header", line)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+func refsPath(project string) string {
+	return "projects/" + project + "/remote-refs"
+}
+
+// RemoteRefs returns the snapshot of the project's remote refs saved by
+// SaveRemoteRefs, as commit hashes by ref names. If there is no snapshot,
+// the map is empty.
+func RemoteRefs(project string) (map[string]string, error) {
+	refs := make(map[string]string)
+	f, err := os.Open(refsPath(project))
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Split(s.Text(), "\t")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("failed to parse ref line: %s", s.Text())
+		}
+		refs[parts[1]] = parts[0]
+	}
+	return refs, s.Err()
+}
+
+// SaveRemoteRefs replaces the snapshot of the project's remote refs.
+// It's written in the format of "git ls-remote".
+func SaveRemoteRefs(project string, refs map[string]string) error {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s\t%s\n", refs[name], name)
+	}
+	return writeFileAtomic(refsPath(project), []byte(b.String()), 0666)
+}
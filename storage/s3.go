@@ -0,0 +1,548 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config has the settings for an S3-compatible object storage.
+type S3Config struct {
+	// Endpoint is the storage's URL, like "https://s3.amazonaws.com"
+	// or "http://localhost:9000" for a local MinIO.
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+
+	// Prefix is prepended to all object keys.
+	Prefix string `json:"prefix"`
+}
+
+// s3Storage keeps builds in an S3-compatible object storage as objects
+// named <prefix><project>/<branch>/<version>/<upload>/<file>. Buckets are addressed
+// in the path style, which works with both AWS and MinIO.
+type s3Storage struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+// S3 returns a storage that keeps builds in an S3-compatible object storage.
+func S3(cfg S3Config) Storage {
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &s3Storage{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+func (s *s3Storage) key(parts ...string) string {
+	return s.cfg.Prefix + strings.Join(parts, "/")
+}
+
+// currentName is the object with the name of the upload that has the
+// current files of a build.
+const currentName = ".current"
+
+// current returns the key prefix of the current files of the build.
+// Every save uploads the files under a new prefix and then switches
+// the build over to it by rewriting the current object. If there is
+// no such build, the error satisfies os.IsNotExist.
+func (s *s3Storage) current(project, branch, version string) (string, error) {
+	resp, err := s.get(s.key(project, branch, version, currentName), 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	id, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	return s.key(project, branch, version, strings.TrimSpace(string(id))) + "/", nil
+}
+
+// Has checks for the current object, which is written last.
+func (s *s3Storage) Has(project, branch, version string) bool {
+	resp, err := s.do("HEAD", s.key(project, branch, version, currentName), nil, nil, 0)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (s *s3Storage) Save(project, branch, version, dir string) error {
+	files, err := lsf(dir)
+	if err != nil {
+		return err
+	}
+	old, err := s.current(project, branch, version)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	prefix := s.key(project, branch, version, id) + "/"
+	for _, name := range baseNames(files) {
+		err := s.upload(prefix+name, dir+"/"+name)
+		if err != nil {
+			s.removeAll(prefix)
+			return fmt.Errorf("failed to upload %s: %v", name, err)
+		}
+	}
+	resp, err := s.do("PUT", s.key(project, branch, version, currentName), nil, strings.NewReader(id), int64(len(id)))
+	if err != nil {
+		s.removeAll(prefix)
+		return err
+	}
+	resp.Body.Close()
+
+	// Delete the files of the previous build of this version.
+	// Downloads of them that are still going will fail.
+	if old == "" {
+		return nil
+	}
+	return s.removeAll(old)
+}
+
+func (s *s3Storage) remove(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// removeAll deletes all objects under the prefix.
+func (s *s3Storage) removeAll(prefix string) error {
+	keys, err := s.listAll(prefix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := s.remove(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move copies the build through a local directory, since objects
+// can't be renamed, and then deletes the old objects.
+func (s *s3Storage) Move(project, from, to, version string) error {
+	prefix, err := s.current(project, from, version)
+	if err != nil {
+		return err
+	}
+	files, err := s.Builds(project, from, version)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "butler-move")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range files {
+		err := s.download(prefix+name, dir+"/"+name)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.Save(project, to, version, dir)
+	if err != nil {
+		return err
+	}
+	return s.removeAll(s.key(project, from, version) + "/")
+}
+
+func (s *s3Storage) download(key, to string) error {
+	resp, err := s.get(key, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+func (s *s3Storage) upload(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", key, nil, f, st.Size())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Build(project, branch, version, file string) (File, error) {
+	prefix, err := s.current(project, branch, version)
+	if err != nil {
+		return nil, err
+	}
+	key := prefix + file
+	resp, err := s.do("HEAD", key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3File{
+		s:   s,
+		key: key,
+		info: fileInfo{
+			name:    file,
+			size:    resp.ContentLength,
+			modTime: modTime,
+		},
+	}, nil
+}
+
+// s3File reads an object with ranged requests, starting a new request
+// after every seek.
+type s3File struct {
+	s    *s3Storage
+	key  string
+	info fileInfo
+	pos  int64
+	body io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.pos >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		resp, err := f.s.get(f.key, f.pos)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.info.size
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("seek %s: negative position", f.key)
+	}
+	if pos != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// fileInfo describes an object as a file.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() os.FileMode  { return 0444 }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return false }
+func (i fileInfo) Sys() interface{}   { return nil }
+
+// get starts reading an object from the given offset.
+func (s *s3Storage) get(key string, offset int64) (*http.Response, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return s.doWithHeader("GET", key, nil, header, nil, 0)
+}
+
+func (s *s3Storage) Branches(project string) ([]string, error) {
+	dirs, _, err := s.list(s.key(project) + "/")
+	return dirs, err
+}
+
+func (s *s3Storage) Versions(project, branch string) ([]string, error) {
+	dirs, _, err := s.list(s.key(project, branch) + "/")
+	return dirs, err
+}
+
+func (s *s3Storage) Builds(project, branch, version string) ([]string, error) {
+	prefix, err := s.current(project, branch, version)
+	if err != nil {
+		return nil, err
+	}
+	_, files, err := s.list(prefix)
+	return files, err
+}
+
+type listBucketResult struct {
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns names of "directories" and objects directly under the prefix.
+// If there is nothing under the prefix, the error satisfies os.IsNotExist,
+// just like listing a missing local directory.
+func (s *s3Storage) list(prefix string) ([]string, []string, error) {
+	dirs := make([]string, 0)
+	files := make([]string, 0)
+	err := s.listPages(prefix, "/", func(result *listBucketResult) {
+		for _, p := range result.CommonPrefixes {
+			dirs = append(dirs, strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"))
+		}
+		for _, c := range result.Contents {
+			files = append(files, strings.TrimPrefix(c.Key, prefix))
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(dirs) == 0 && len(files) == 0 {
+		return nil, nil, os.ErrNotExist
+	}
+	return dirs, files, nil
+}
+
+// listAll returns keys of all objects under the prefix.
+func (s *s3Storage) listAll(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := s.listPages(prefix, "", func(result *listBucketResult) {
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return keys, nil
+}
+
+// listPages lists the bucket page by page.
+func (s *s3Storage) listPages(prefix, delimiter string, page func(*listBucketResult)) error {
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse bucket listing: %v", err)
+		}
+		page(&result)
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do makes a signed request for the given object key, or for the bucket
+// itself if the key is empty. Responses with error statuses are turned
+// into errors, with 404 satisfying os.IsNotExist.
+func (s *s3Storage) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	return s.doWithHeader(method, key, query, nil, body, size)
+}
+
+// doWithHeader is like do, but also sends the given unsigned headers.
+func (s *s3Storage) doWithHeader(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	p := "/" + uriEncode(s.cfg.Bucket, true)
+	if key != "" {
+		p += "/" + uriEncode(key, false)
+	}
+	u, err := url.Parse(s.cfg.Endpoint + p)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, p, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request.
+// The payload is not signed, which saves reading uploaded files twice.
+func (s *s3Storage) sign(req *http.Request, canonicalPath string, t time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := s3SigningKey(s.cfg.SecretKey, date, s.cfg.Region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3SigningKey derives the key that signs requests to the service
+// on the given date.
+func s3SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// uriEncode encodes a string the way AWS signatures require: everything
+// except letters, digits and "-._~" is percent-encoded, and slashes are
+// encoded only if encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '.' || ch == '_' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name, as AWS signatures require.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory object storage that speaks enough of the S3 API
+// for the S3 backend: object PUT, GET, HEAD and DELETE, and bucket listing.
+// Requests with a wrong signature are refused.
+type fakeS3 struct {
+	bucket   string
+	secret   string
+	pageSize int
+
+	// onPut, if set, is called before an object is stored.
+	onPut func(key string)
+
+	mu      sync.Mutex
+	objects map[string][]byte
+
+	// gets counts GET requests by object key.
+	gets map[string]int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, S3Config) {
+	f := &fakeS3{
+		bucket:   "butler",
+		secret:   "secret",
+		pageSize: 1000,
+		objects:  make(map[string][]byte),
+		gets:     make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    f.bucket,
+		AccessKey: "butler",
+		SecretKey: f.secret,
+		Prefix:    "builds dir/",
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.validSignature(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	if key == "" {
+		if r.Method != "GET" || r.URL.Query().Get("list-type") != "2" {
+			http.Error(w, "not implemented", http.StatusNotImplemented)
+			return
+		}
+		f.list(w, r.URL.Query())
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.onPut != nil {
+			f.onPut(key)
+		}
+		f.mu.Lock()
+		f.objects[key] = data
+		f.mu.Unlock()
+	case "GET", "HEAD":
+		f.mu.Lock()
+		data, ok := f.objects[key]
+		if r.Method == "GET" {
+			f.gets[key]++
+		}
+		f.mu.Unlock()
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	case "DELETE":
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// list answers a ListObjectsV2 request. Continuation tokens are
+// the last key or common prefix of the previous page.
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	token := q.Get("continuation-token")
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	var result listBucketResult
+	n := 0
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= token ||
+			(strings.HasSuffix(token, delimiter) && delimiter != "" && strings.HasPrefix(key, token)) {
+			continue
+		}
+		entry := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry = key[:len(prefix)+i+len(delimiter)]
+			if entry == last {
+				continue
+			}
+		}
+		if n == f.pageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if entry == key {
+			result.Contents = append(result.Contents, struct{ Key string }{key})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{entry})
+		}
+		last = entry
+		n++
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// validSignature checks the request's signature, building the canonical
+// request from what was received rather than from what the client meant.
+func (f *fakeS3) validSignature(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 {
+		return false
+	}
+	scope := credential[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 {
+		return false
+	}
+
+	q := r.URL.Query()
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	query := make([]string, 0, len(names))
+	escape := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+	}
+	for _, name := range names {
+		query = append(query, escape(name)+"="+escape(q.Get(name)))
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	headers := make([]string, 0, len(signedHeaders))
+	for _, h := range signedHeaders {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers = append(headers, h+":"+v+"\n")
+	}
+
+	canonicalRequest := r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		strings.Join(query, "&") + "\n" +
+		strings.Join(headers, "") + "\n" +
+		fields["SignedHeaders"] + "\n" +
+		r.Header.Get("x-amz-content-sha256")
+	amzDate := r.Header.Get("x-amz-date")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := s3SigningKey(f.secret, scopeParts[0], scopeParts[1], scopeParts[2])
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)) == fields["Signature"]
+}
+
+// keys returns the stored keys with the given prefix.
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := make([]string, 0)
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			r = append(r, key)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// buildDir writes the given files to a new directory.
+func buildDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		err := ioutil.WriteFile(dir+"/"+name, []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readS3File(t *testing.T, s Storage, project, branch, version, file string) string {
+	t.Helper()
+	f, err := s.Build(project, branch, version, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// The example from the AWS documentation on deriving the signing key.
+func TestS3SigningKey(t *testing.T) {
+	key := s3SigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got := hex.EncodeToString(key); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestS3WrongSecret(t *testing.T) {
+	_, cfg := newFakeS3(t)
+	cfg.SecretKey = "wrong"
+	s := S3(cfg)
+	_, err := s.Versions("app", "master")
+	if err == nil || os.IsNotExist(err) || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want a 403 error", err)
+	}
+}
+
+func TestS3SaveOpen(t *testing.T) {
+	_, cfg := newFakeS3(t)
+	s := S3(cfg)
+	if s.Has("app", "master", "1.0.0") {
+		t.Error("Has before Save")
+	}
+	err := s.Save("app", "master", "1.0.0", buildDir(t, map[string]string{
+		"app.apk":    "hello world",
+		"build.json": "{}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has("app", "master", "1.0.0") {
+		t.Error("no build after Save")
+	}
+
+	files, err := s.Builds("app", "master", "1.0.0")
+	if err != nil || !reflect.DeepEqual(files, []string{"app.apk", "build.json"}) {
+		t.Errorf("Builds = %q, %v", files, err)
+	}
+	branches, err := s.Branches("app")
+	if err != nil || !reflect.DeepEqual(branches, []string{"master"}) {
+		t.Errorf("Branches = %q, %v", branches, err)
+	}
+	versions, err := s.Versions("app", "master")
+	if err != nil || !reflect.DeepEqual(versions, []string{"1.0.0"}) {
+		t.Errorf("Versions = %q, %v", versions, err)
+	}
+
+	f, err := s.Build("app", "master", "1.0.0", "app.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.Size() != 11 || st.Name() != "app.apk" {
+		t.Errorf("Stat = %+v, %v", st, err)
+	}
+	b := make([]byte, 5)
+	if _, err := f.Read(b); err != nil || string(b) != "hello" {
+		t.Errorf("Read = %q, %v", b, err)
+	}
+	if _, err := f.Seek(-5, 2); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || string(rest) != "world" {
+		t.Errorf("read %q after seeking, %v", rest, err)
+	}
+
+	_, err = s.Build("app", "master", "1.0.0", "missing.apk")
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing file", err)
+	}
+	_, err = s.Versions("app", "develop")
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing branch", err)
+	}
+}
+
+func TestS3ListingPages(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	fake.pageSize = 2
+	s := S3(cfg)
+	want := []string{}
+	for i := 0; i < 5; i++ {
+		v := "1.0." + strconv.Itoa(i)
+		want = append(want, v)
+		err := s.Save("app", "master", v, buildDir(t, map[string]string{"a": "", "b": "", "c": ""}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := s.Versions("app", "master")
+	if err != nil || !reflect.DeepEqual(versions, want) {
+		t.Errorf("Versions = %q, %v, want %q", versions, err, want)
+	}
+	files, err := s.Builds("app", "master", "1.0.3")
+	if err != nil || !reflect.DeepEqual(files, []string{"a", "b", "c"}) {
+		t.Errorf("Builds = %q, %v", files, err)
+	}
+}
+
+// While a version is being rebuilt, readers see the whole previous build.
+func TestS3SaveReplaces(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	s := S3(cfg)
+	err := s.Save("app", "master", "1.0.0", buildDir(t, map[string]string{"app.apk": "1", "old.apk": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := 0
+	fake.onPut = func(key string) {
+		if strings.HasSuffix(key, "/"+currentName) {
+			return
+		}
+		uploads++
+		files, err := s.Builds("app", "master", "1.0.0")
+		if err != nil || !reflect.DeepEqual(files, []string{"app.apk", "old.apk"}) {
+			t.Errorf("Builds = %q, %v while uploading %s", files, err, key)
+		}
+		if got := readS3File(t, s, "app", "master", "1.0.0", "app.apk"); got != "1" {
+			t.Errorf("read %q while uploading %s, want the old build", got, key)
+		}
+	}
+	err = s.Save("app", "master", "1.0.0", buildDir(t, map[string]string{"app.apk": "2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.onPut = nil
+	if uploads != 1 {
+		t.Errorf("%d uploads, want 1", uploads)
+	}
+
+	files, err := s.Builds("app", "master", "1.0.0")
+	if err != nil || !reflect.DeepEqual(files, []string{"app.apk"}) {
+		t.Errorf("Builds = %q, %v", files, err)
+	}
+	if got := readS3File(t, s, "app", "master", "1.0.0", "app.apk"); got != "2" {
+		t.Errorf("read %q, want the new build", got)
+	}
+	if keys := fake.keys(cfg.Prefix + "app/master/1.0.0/"); len(keys) != 2 {
+		t.Errorf("objects left: %q, want the current object and the new file", keys)
+	}
+}
+
+func TestS3Move(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	s := S3(cfg)
+	err := s.Save("app", "feature", "1.0.0", buildDir(t, map[string]string{"app.apk": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Move("app", "feature", "master", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("app", "feature", "1.0.0") || !s.Has("app", "master", "1.0.0") {
+		t.Error("the build was not moved")
+	}
+	if keys := fake.keys(cfg.Prefix + "app/feature/"); len(keys) != 0 {
+		t.Errorf("objects left: %q", keys)
+	}
+	if got := readS3File(t, s, "app", "master", "1.0.0", "app.apk"); got != "1" {
+		t.Errorf("read %q", got)
+	}
+}
+
+// Builds kept in S3 are downloaded to the given directory.
+func TestS3BuildDir(t *testing.T) {
+	inTempDir(t)
+	_, cfg := newFakeS3(t)
+	SetBackend(S3(cfg))
+	defer SetBackend(Local())
+	err := backend.Save("lib", "master", "1.0.0", buildDir(t, map[string]string{"lib.jar": "jar"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir() + "/lib"
+	dir, err := BuildDir("lib", "master", "1.0.0", tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != tmp {
+		t.Errorf("got %s, want %s", dir, tmp)
+	}
+	data, err := ioutil.ReadFile(dir + "/lib.jar")
+	if err != nil || string(data) != "jar" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	if _, err := os.Stat("tmp"); !os.IsNotExist(err) {
+		t.Errorf("something was written to tmp: %v", err)
+	}
+}
+
+// Files in S3 are hashed once, in the background, and damaged ones
+// are refused from then on.
+func TestS3Verify(t *testing.T) {
+	inTempDir(t)
+	fake, cfg := newFakeS3(t)
+	SetBackend(S3(cfg))
+	defer SetBackend(Local())
+	saveArtifacts(t, map[string]string{"app.apk": "apk data", "app.aab": "aab data"})
+	var apk, aab string
+	for _, key := range fake.keys(cfg.Prefix + "app/master/1.0.0/") {
+		switch path.Base(key) {
+		case "app.apk":
+			apk = key
+		case "app.aab":
+			aab = key
+		}
+	}
+	fake.objects[aab] = []byte("AAB data")
+
+	for i := 0; i < 3; i++ {
+		if _, err := Verify("app", "master", "1.0.0", "app.apk"); err != nil {
+			t.Fatal(err)
+		}
+		verified.wg.Wait()
+	}
+	fake.mu.Lock()
+	n := fake.gets[apk]
+	fake.mu.Unlock()
+	if n != 1 {
+		t.Errorf("the file was read %d times, want 1", n)
+	}
+
+	if _, err := Verify("app", "master", "1.0.0", "app.aab"); err != nil {
+		t.Errorf("first Verify of a changed file = %v, want no error", err)
+	}
+	verified.wg.Wait()
+	if _, err := Verify("app", "master", "1.0.0", "app.aab"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Verify of a changed file = %v, want ErrIntegrity", err)
+	}
+}
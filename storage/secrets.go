@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// MasterKeyPath is the file with the key used to encrypt secrets.
+// The key can also be given in the BUTLER_MASTER_KEY environment variable
+// as a base64 string, in which case the file is not used.
+const MasterKeyPath = "master.key"
+
+func secretsPath(project string) string {
+	return "projects/" + project + "/secrets"
+}
+
+// masterKey returns the key for encrypting secrets. If create is true and
+// there is no key yet, a new one is generated and saved.
+func masterKey(create bool) ([]byte, error) {
+	if s := os.Getenv("BUTLER_MASTER_KEY"); s != "" {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BUTLER_MASTER_KEY: %v", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid BUTLER_MASTER_KEY: need 32 bytes, got %d", len(key))
+		}
+		return key, nil
+	}
+
+	key, err := ioutil.ReadFile(MasterKeyPath)
+	if os.IsNotExist(err) && create {
+		key = make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, key)
+		if err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(MasterKeyPath, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid master key in %s: need 32 bytes, got %d", MasterKeyPath, len(key))
+	}
+	return key, nil
+}
+
+func secretsCipher(create bool) (cipher.AEAD, error) {
+	key, err := masterKey(create)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Secrets returns the project's secrets as a map of variable names to values.
+func Secrets(project string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(secretsPath(project))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := secretsCipher(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get master key: %v", err)
+	}
+	n := aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("secrets file is truncated")
+	}
+	plain, err := aead.Open(nil, data[:n], data[n:], []byte(project))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secrets: %v", err)
+	}
+
+	secrets := make(map[string]string)
+	err = json.Unmarshal(plain, &secrets)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func saveSecrets(project string, secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	aead, err := secretsCipher(true)
+	if err != nil {
+		return fmt.Errorf("failed to get master key: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	data := aead.Seal(nonce, nonce, plain, []byte(project))
+
+	p := secretsPath(project)
+	err = os.MkdirAll(path.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0600)
+}
+
+// SetSecret sets the value of a project's secret.
+func SetSecret(project, name, value string) error {
+	secrets, err := Secrets(project)
+	if err != nil {
+		return err
+	}
+	secrets[name] = value
+	return saveSecrets(project, secrets)
+}
+
+// DeleteSecret removes a project's secret.
+func DeleteSecret(project, name string) error {
+	secrets, err := Secrets(project)
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return fmt.Errorf("no secret %s in %s", name, project)
+	}
+	delete(secrets, name)
+	return saveSecrets(project, secrets)
+}
+
+// SecretNames returns a sorted list of names of the project's secrets.
+func SecretNames(project string) ([]string, error) {
+	secrets, err := Secrets(project)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
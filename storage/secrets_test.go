@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSecretsRoundTrip(t *testing.T) {
+	inTempDir(t)
+	t.Setenv("BUTLER_MASTER_KEY", "")
+
+	secrets, err := Secrets("app")
+	if err != nil || len(secrets) != 0 {
+		t.Fatalf("Secrets of a new project = %v, %v, want an empty map", secrets, err)
+	}
+	if err := SetSecret("app", "TOKEN", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSecret("app", "PASSWORD", "p4ss"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSecret("app", "TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSecret("app", "TOKEN"); err == nil {
+		t.Error("deleting a missing secret succeeded")
+	}
+
+	secrets, err = Secrets("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"PASSWORD": "p4ss"}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("Secrets = %v, want %v", secrets, want)
+	}
+	names, err := SecretNames("app")
+	if err != nil || !reflect.DeepEqual(names, []string{"PASSWORD"}) {
+		t.Errorf("SecretNames = %v, %v", names, err)
+	}
+
+	// The values must not be stored in plain text.
+	data, err := ioutil.ReadFile(secretsPath("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("p4ss")) || bytes.Contains(data, []byte("PASSWORD")) {
+		t.Error("the secrets file has plain text")
+	}
+}
+
+func TestSecretsBoundToProject(t *testing.T) {
+	inTempDir(t)
+	t.Setenv("BUTLER_MASTER_KEY", "")
+	if err := SetSecret("a", "X", "1"); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll("projects/b", 0777)
+	data, _ := ioutil.ReadFile(secretsPath("a"))
+	ioutil.WriteFile(secretsPath("b"), data, 0600)
+	if _, err := Secrets("b"); err == nil {
+		t.Error("secrets copied from another project were decrypted")
+	}
+}
+
+func TestSecretsTampered(t *testing.T) {
+	inTempDir(t)
+	t.Setenv("BUTLER_MASTER_KEY", "")
+	if err := SetSecret("a", "X", "1"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(secretsPath("a"))
+	data[len(data)-1] ^= 1
+	ioutil.WriteFile(secretsPath("a"), data, 0600)
+	if _, err := Secrets("a"); err == nil {
+		t.Error("tampered secrets were decrypted")
+	}
+	ioutil.WriteFile(secretsPath("a"), data[:5], 0600)
+	if _, err := Secrets("a"); err == nil {
+		t.Error("truncated secrets were decrypted")
+	}
+}
+
+func TestMasterKeyFromEnv(t *testing.T) {
+	inTempDir(t)
+	key := bytes.Repeat([]byte{7}, 32)
+	t.Setenv("BUTLER_MASTER_KEY", base64.StdEncoding.EncodeToString(key))
+	if err := SetSecret("a", "X", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(MasterKeyPath); !os.IsNotExist(err) {
+		t.Error("a key file was created although the key is in the environment")
+	}
+
+	// Another key can't decrypt the secrets.
+	t.Setenv("BUTLER_MASTER_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	if _, err := Secrets("a"); err == nil {
+		t.Error("secrets were decrypted with another key")
+	}
+
+	t.Setenv("BUTLER_MASTER_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := Secrets("a"); err == nil {
+		t.Error("a short key was accepted")
+	}
+}
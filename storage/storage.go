@@ -1,12 +1,12 @@
 package storage
 
 import (
+	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -19,6 +19,24 @@ const ReleasesDirectory = "releases"
 type Project struct {
 	Name string
 	Env  []string
+
+	// DependsOn lists upstream projects this project is rebuilt after.
+	DependsOn []Dependency
+
+	// Triggers lists downstream projects rebuilt after this project.
+	Triggers []Dependency
+
+	// Remote is the project's repository if butler manages the clone,
+	// or nil if the source was cloned by hand.
+	Remote *Remote
+
+	// PollInterval is how often the project is updated,
+	// zero to update it as often as possible.
+	PollInterval time.Duration
+
+	// Overrides has patterns of names of variables that build
+	// requests may set.
+	Overrides []string
 }
 
 // SourcePath returns path to a project's source directory.
@@ -26,42 +44,60 @@ func SourcePath(project string) string {
 	return "projects/" + project + "/src"
 }
 
-func versionsPath(project, branch string) string {
-	return "projects/" + project + "/builds/" + safeString(branch)
+// Has returns true if there are saved results for given project, branch and version.
+func Has(project, branch, version string) bool {
+	return backend.Has(project, branchKey(branch), safeString(version))
 }
 
-func buildsPath(project, branch, version string) string {
-	return versionsPath(project, branch) + "/" + safeString(version)
+// reservedNames are names that can't be project names.
+var reservedNames []string
+
+// ReserveNames makes project directories with the given names ignored,
+// for names that addresses of other pages start with.
+func ReserveNames(names ...string) {
+	reservedNames = names
 }
 
-// Has returns true if there are saved results for given project, branch and version.
-func Has(project, branch, version string) bool {
-	path := buildsPath(project, branch, version)
-	_, err := os.Stat(path)
-	return err == nil
+// Reserved returns true if the name can't be a project name.
+func Reserved(name string) bool {
+	for _, r := range reservedNames {
+		if r == name {
+			return true
+		}
+	}
+	return false
 }
 
-func parseDotEnv(path string) ([]string, error) {
-	data, err := ioutil.ReadFile(path)
+// projectDirs returns the directories of the projects.
+func projectDirs() ([]string, error) {
+	dirs, err := lsd("projects")
 	if err != nil {
 		return nil, err
 	}
-
-	list := make([]string, 0)
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+	r := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !Reserved(path.Base(dir)) {
+			r = append(r, dir)
 		}
-		list = append(list, line)
 	}
-	return list, nil
+	return r, nil
+}
+
+// ProjectNames returns the names of all projects, including those
+// whose settings can't be read.
+func ProjectNames() ([]string, error) {
+	dirs, err := projectDirs()
+	if err != nil {
+		return nil, err
+	}
+	names := baseNames(dirs)
+	sort.Strings(names)
+	return names, nil
 }
 
 // Projects returns the current list of projects.
 func Projects() ([]Project, error) {
-	dirs, err := lsd("projects")
+	dirs, err := projectDirs()
 	if err != nil {
 		return nil, err
 	}
@@ -73,49 +109,202 @@ func Projects() ([]Project, error) {
 			return nil, err
 		}
 
+		cfg, err := readProjectConfig(dir)
+		if err != nil {
+			return nil, err
+		}
+
 		projects[i] = Project{
-			Name: path.Base(dir),
-			Env:  env,
+			Name:         path.Base(dir),
+			Env:          env,
+			DependsOn:    cfg.DependsOn,
+			Triggers:     cfg.Triggers,
+			Remote:       cfg.Remote,
+			PollInterval: time.Duration(cfg.PollInterval) * time.Second,
+			Overrides:    cfg.Overrides,
 		}
 	}
 	return projects, nil
 }
 
-// BuildLogger creates and returns a log writer for a build process.
-func BuildLogger(project, branch, version string) (io.WriteCloser, error) {
-	logPath := versionsPath(project, branch) + "/" + safeString(version) + "/build.log"
-	err := os.MkdirAll(path.Dir(logPath), 0777)
+// BuildLogger starts a new build of the given project, branch and version
+// and returns a log writer for it. Any of the given secret values written
+// to the log are masked. The log and other results of the build are visible
+// only after Commit.
+func BuildLogger(project, branch, version string, origin Origin, secrets []string) (io.WriteCloser, error) {
+	staging := stagingPath(project, branch, version)
+	// Clear whatever was left from a build that didn't finish.
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(staging, 0777)
+	if err != nil {
+		return nil, err
+	}
+	logPath := staging + "/" + LogName
+	f, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintln(f, logHeader(time.Now(), origin))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newMaskWriter(f, secrets), nil
+}
+
+// Origin is what a build is made of: the full name of the ref, like
+// "refs/tags/1.0.0", and whether the build was requested through the API.
+// It's written to the log, so that an interrupted build can be made again.
+type Origin struct {
+	Ref       string
+	Requested bool
+}
+
+// logHeader returns the first line of a build log, like
+// "build started at 2024-01-02T03:04:05Z from refs/heads/master".
+// Ref names can't have spaces, so the line can be split by them.
+func logHeader(started time.Time, origin Origin) string {
+	line := "build started at " + started.UTC().Format(time.RFC3339Nano) + " from " + origin.Ref
+	if origin.Requested {
+		line += " on request"
+	}
+	return line
+}
+
+// readLogHeader returns the start time and the origin of a build
+// from the header of its log.
+func readLogHeader(logPath string) (time.Time, Origin, bool) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return time.Time{}, Origin{}, false
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) < 6 || strings.Join(fields[:3], " ") != "build started at" || fields[4] != "from" {
+		return time.Time{}, Origin{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[3])
+	if err != nil {
+		return time.Time{}, Origin{}, false
+	}
+	origin := Origin{Ref: fields[5], Requested: strings.Join(fields[6:], " ") == "on request"}
+	return t, origin, true
+}
+
+// LiveLog opens the log of a build in progress. If there is no such build,
+// the returned error satisfies os.IsNotExist.
+func LiveLog(project, branch, version string) (*os.File, error) {
+	return os.Open(stagingPath(project, branch, version) + "/" + LogName)
+}
+
+// maxUpdateLog is the size after which the update log is rotated.
+const maxUpdateLog = 1 << 20
+
+// UpdateLog returns a writer for the log of the project's source update.
+// The output of every update is appended to the log after a line with
+// the time. When the log grows over maxUpdateLog, it's renamed to
+// update.log.1, replacing the older one, and a new log is started.
+func UpdateLog(project string) (io.WriteCloser, error) {
+	p := "projects/" + project + "/update.log"
+	if st, err := os.Stat(p); err == nil && st.Size() > maxUpdateLog {
+		err := os.Rename(p, p+".1")
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(f, "--- %s\n", time.Now().Format(time.RFC3339))
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	return os.Create(logPath)
+	return f, nil
 }
 
-// Build returns a reader for a build file.
-func Build(project, branch, version, file string) (io.ReadCloser, error) {
-	return os.Open(buildsPath(project, branch, version) + "/" + safeString(file))
+// BuildDir returns the absolute path to a local directory with the files
+// of the given build. If the builds are kept elsewhere, they are downloaded
+// to the given temporary directory, which the caller removes when done.
+func BuildDir(project, branch, version, tmp string) (string, error) {
+	if l, ok := backend.(*localStorage); ok {
+		return filepath.Abs(l.dir(project, branchKey(branch), safeString(version)))
+	}
+	files, err := Builds(project, branch, version)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(tmp, 0777)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range files {
+		err = download(project, branch, version, name, tmp+"/"+name)
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Abs(tmp)
 }
 
-// SaveBuilds stores build outputs for the given project, branch and version.
-func SaveBuilds(project, branch, version string, files []string) error {
-	err := copyFiles(files, buildsPath(project, branch, version))
+func download(project, branch, version, name, to string) error {
+	r, err := Build(project, branch, version, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Build opens a build file.
+func Build(project, branch, version, file string) (File, error) {
+	return backend.Build(project, branchKey(branch), safeString(version), safeString(file))
+}
+
+// SaveBuilds stores build outputs for the given project, branch and version
+// and writes a manifest describing them. Like the log, the outputs are
+// visible only after Commit.
+func SaveBuilds(project, branch, version string, files []Artifact) error {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	err := copyFiles(paths, stagingPath(project, branch, version))
 	if err != nil {
 		return fmt.Errorf("failed to copy files: %v", err)
 	}
+	err = writeManifest(project, branch, version, files)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
 	return nil
 }
 
 // Branches returns a list of project's branches.
 func Branches(project string) ([]string, error) {
-	dirs, err := lsd("projects/" + project + "/builds")
+	keys, err := backend.Branches(project)
 	if err != nil {
 		return nil, err
 	}
-
-	branches := make([]string, len(dirs))
-	for i, dir := range dirs {
-		branches[i] = path.Base(dir)
+	branches := make([]string, len(keys))
+	for i, key := range keys {
+		branches[i] = branchName(key)
 	}
+	sort.Strings(branches)
 	return branches, nil
 }
 
@@ -127,24 +316,28 @@ func baseNames(paths []string) []string {
 	return names
 }
 
-// Versions returns a list of build versions.
+// Versions returns a list of build versions, newest first.
 func Versions(project, branch string) ([]string, error) {
-	l, err := lsd(versionsPath(project, branch))
+	r, err := backend.Versions(project, branchKey(branch))
 	if err != nil {
 		return nil, err
 	}
-	r := baseNames(l)
-	sort.Sort(sort.Reverse(sort.StringSlice(r)))
+	sortVersions(r)
 	return r, nil
 }
 
-// Builds returns a list of builds.
+// Builds returns a list of files of the build, except hidden ones.
 func Builds(project, branch, version string) ([]string, error) {
-	files, err := lsf(buildsPath(project, branch, version))
+	all, err := backend.Builds(project, branchKey(branch), safeString(version))
 	if err != nil {
 		return nil, err
 	}
-	r := baseNames(files)
+	r := make([]string, 0, len(all))
+	for _, name := range all {
+		if !Hidden(name) {
+			r = append(r, name)
+		}
+	}
 	sort.Strings(r)
 	return r, nil
 }
@@ -192,12 +385,12 @@ func ls(dir string, filter func(f os.FileInfo) bool) ([]string, error) {
 		return nil, err
 	}
 
-	result := make([]string, len(ls))
-	for i, l := range ls {
+	result := make([]string, 0, len(ls))
+	for _, l := range ls {
 		if !filter(l) {
 			continue
 		}
-		result[i] = dir + "/" + l.Name()
+		result = append(result, dir+"/"+l.Name())
 	}
 	return result, nil
 }
@@ -221,10 +414,6 @@ func Stash(files []string, envName string) ([]string, error) {
 	return r, nil
 }
 
-func copyFile(from, to string) error {
-	return exec.Command("cp", from, to).Run()
-}
-
 func copyFiles(paths []string, to string) error {
 	err := os.MkdirAll(to, 0777)
 	if err != nil {
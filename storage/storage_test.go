@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReservedNames(t *testing.T) {
+	inTempDir(t)
+	for _, dir := range []string{"projects/app", "projects/metrics", "projects/api"} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ReserveNames("api", "metrics")
+	defer ReserveNames()
+
+	names, err := ProjectNames()
+	if err != nil || !reflect.DeepEqual(names, []string{"app"}) {
+		t.Errorf("ProjectNames = %q, %v", names, err)
+	}
+	projects, err := Projects()
+	if err != nil || len(projects) != 1 || projects[0].Name != "app" {
+		t.Errorf("Projects = %+v, %v", projects, err)
+	}
+}
+
+func TestUpdateLog(t *testing.T) {
+	inTempDir(t)
+	os.MkdirAll("projects/app", 0777)
+	write := func(s string) {
+		t.Helper()
+		w, err := UpdateLog("app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(s))
+		w.Close()
+	}
+	write("first\n")
+	write("second\n")
+	data, _ := ioutil.ReadFile("projects/app/update.log")
+	if !strings.Contains(string(data), "first") || !strings.Contains(string(data), "second") {
+		t.Errorf("the log has %q, want both updates", data)
+	}
+
+	write(strings.Repeat("x", maxUpdateLog))
+	write("third\n")
+	data, _ = ioutil.ReadFile("projects/app/update.log")
+	if strings.Contains(string(data), "first") || !strings.Contains(string(data), "third") {
+		t.Errorf("the log wasn't rotated: %d bytes", len(data))
+	}
+	old, _ := ioutil.ReadFile("projects/app/update.log.1")
+	if !strings.Contains(string(old), "first") {
+		t.Error("the rotated log doesn't have the earlier updates")
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	inTempDir(t)
+	os.MkdirAll("projects/app", 0777)
+	p, err := KnownHosts("app", []string{"github.com ssh-ed25519 AAAA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(p, old, old)
+
+	_, err = KnownHosts("app", []string{"github.com ssh-ed25519 AAAA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := os.Stat(p); !st.ModTime().Equal(old) {
+		t.Error("the file was rewritten without changes")
+	}
+
+	_, err = KnownHosts("app", []string{"github.com ssh-ed25519 AAAA", "gitlab.com ssh-ed25519 BBBB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(p)
+	if string(data) != "github.com ssh-ed25519 AAAA\ngitlab.com ssh-ed25519 BBBB\n" {
+		t.Errorf("the file has %q", data)
+	}
+	// The file was replaced, and nothing is left from writing it.
+	files, _ := ioutil.ReadDir("projects/app")
+	if len(files) != 1 || files[0].Name() != "known_hosts" {
+		t.Errorf("files left: %v", files)
+	}
+	if runtime.GOOS != "windows" && files[0].Mode().Perm() != 0600 {
+		t.Errorf("the file has mode %v", files[0].Mode())
+	}
+}
@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DiskUsage returns the total size of the project's builds on the local disk.
+// If the builds are kept elsewhere, the returned error satisfies os.IsNotExist.
+func DiskUsage(project string) (int64, error) {
+	if _, ok := backend.(*localStorage); !ok {
+		return 0, os.ErrNotExist
+	}
+	var size int64
+	err := filepath.Walk("projects/"+project+"/builds", func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() {
+			size += f.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
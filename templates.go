@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var templateFuncs = template.FuncMap{
+	"url": urlFor,
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+	"bytes": func(n uint64) string {
+		const unit = 1024
+		if n < unit {
+			return fmt.Sprintf("%d B", n)
+		}
+		div, exp := uint64(unit), 0
+		for m := n / unit; m >= unit; m /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+	},
+	"short": func(commit string) string {
+		if len(commit) > 8 {
+			return commit[:8]
+		}
+		return commit
+	},
+}
+
+// pages has a template for every page, each combined with the common layout.
+var pages = map[string]*template.Template{
+	"dashboard":   page("dashboard"),
+	"project":     page("project"),
+	"branch":      page("branch"),
+	"version":     page("version"),
+	"diagnostics": page("diagnostics"),
+}
+
+func page(name string) *template.Template {
+	return template.Must(template.New("layout.html").Funcs(templateFuncs).
+		ParseFS(templateFiles, "templates/layout.html", "templates/"+name+".html"))
+}
+
+// render renders a page with the given data.
+func render(w http.ResponseWriter, name string, data interface{}) {
+	// Render into a buffer first, so that a failed template
+	// doesn't leave a half-written page.
+	var b bytes.Buffer
+	err := pages[name].Execute(&b, data)
+	if err != nil {
+		statusPage(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	b.WriteTo(w)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaswelder/butler/storage"
+)
+
+// commitBuild saves a numbered build with a description and one file.
+func commitBuild(t *testing.T, project, branch, version, message string) {
+	t.Helper()
+	n, err := storage.NewBuildNumber(project, branch, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := storage.BuildLogger(project, branch, version, storage.Origin{Ref: "refs/heads/" + branch}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write([]byte("building " + branch + "\n"))
+	log.Close()
+	apk := t.TempDir() + "/app.apk"
+	err = ioutil.WriteFile(apk, []byte("apk"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.SaveBuilds(project, branch, version, []storage.Artifact{{Path: apk, Builder: "gradle", Dir: ".", Variant: "debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = storage.SaveInfo(project, branch, version, &storage.BuildInfo{
+		Number:   n,
+		Commit:   "0123456789abcdef",
+		Author:   message,
+		Message:  message,
+		Started:  now,
+		Finished: now,
+		Status:   storage.StatusOK,
+		Cells: []storage.Cell{
+			{Builder: "gradle", Dir: ".", Variant: "debug", Status: storage.StatusOK, Files: []string{"app.apk"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Commit(project, branch, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var hrefs = regexp.MustCompile(`href="([^"]*)"`)
+
+// Branch names come from repositories, so they are untrusted input to
+// every page and link. Whatever they are, pages must escape them and
+// links must lead back to the same branch.
+func TestHostileBranchNames(t *testing.T) {
+	const script = "<script>alert(1)</script>"
+	tests := []struct {
+		branch string
+		// routable is false for names that git doesn't allow either,
+		// which can't be addressed by the URLs.
+		routable bool
+	}{
+		{"feature/login", true},
+		{"feature-login", true},
+		{script, true},
+		{`"quoted" & 'single'`, true},
+		{"feature%2Flogin", true},
+		{"a b?c#d", true},
+		{"ветка/ünïcödé", true},
+		{"../../etc", false},
+		{".hidden", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.branch, func(t *testing.T) {
+			inTempDir(t)
+			writeFiles(t, map[string]string{"projects/app/.env": ""})
+			commitBuild(t, "app", tt.branch, "1.0.0", script)
+
+			if !tt.routable {
+				w := httptest.NewRecorder()
+				routes.ServeHTTP(w, httptest.NewRequest("GET", urlFor("branch", "app", tt.branch), nil))
+				if w.Code != 400 {
+					t.Errorf("got %d for the branch page, want 400", w.Code)
+				}
+				return
+			}
+
+			branches, err := storage.Branches("app")
+			if err != nil || len(branches) != 1 || branches[0] != tt.branch {
+				t.Fatalf("Branches = %q, %v", branches, err)
+			}
+
+			// Go through every page linked from the dashboard.
+			seen := map[string]bool{}
+			queue := []string{"/"}
+			for len(queue) > 0 {
+				u := queue[0]
+				queue = queue[1:]
+				if seen[u] {
+					continue
+				}
+				seen[u] = true
+
+				w := httptest.NewRecorder()
+				routes.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+				if w.Code == 302 {
+					queue = append(queue, w.Header().Get("Location"))
+					continue
+				}
+				if w.Code != 200 {
+					t.Errorf("GET %s: %d: %s", u, w.Code, w.Body)
+					continue
+				}
+				body := w.Body.String()
+				if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+					continue
+				}
+				if strings.Contains(body, "<script>") {
+					t.Errorf("%s has an unescaped script", u)
+				}
+				for _, m := range hrefs.FindAllStringSubmatch(body, -1) {
+					queue = append(queue, html.UnescapeString(m[1]))
+				}
+			}
+
+			// The pages of the branch, its version and file were all reached.
+			for _, want := range []string{
+				urlFor("branch", "app", tt.branch),
+				urlFor("version", "app", tt.branch, "1.0.0"),
+				urlFor("file", "app", tt.branch, "1.0.0", "app.apk"),
+			} {
+				if !seen[want] {
+					t.Errorf("%s is not linked from any page", want)
+				}
+			}
+
+			// The branch page shows the branch name as it is.
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, httptest.NewRequest("GET", urlFor("branch", "app", tt.branch), nil))
+			if !strings.Contains(w.Body.String(), html.EscapeString(tt.branch)) {
+				t.Errorf("the branch page doesn't have the branch name")
+			}
+		})
+	}
+}